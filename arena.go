@@ -0,0 +1,86 @@
+package topk
+
+import "unsafe"
+
+// maxArenaChunk caps the size chunks of a key arena grow to
+const maxArenaChunk = 1 << 20
+
+// WithKeyArena copies admitted keys into a key arena instead of allocating
+// each separately: key bytes are appended to chunks of size bytes, growing
+// by doubling up to 1MiB, and monitored keys point into them.  This reduces
+// small allocations and heap fragmentation when n is large and keys churn.
+// Keys larger than a chunk are allocated on their own.
+//
+// A chunk stays alive for as long as any key pointing into it is reachable,
+// including keys returned by Keys and held by the caller.  The bytes of
+// evicted keys are not reused, so under churn the arena keeps growing until
+// Clear or ResetN, which start new chunks and leave the old ones to be
+// collected once their keys are unreachable.  The arena is ignored if keys
+// are interned or stored WithoutKeyCopy.
+func WithKeyArena(size int) Option {
+	return func(s *Stream) {
+		if size <= 0 {
+			s.arena = nil
+			return
+		}
+		s.arena = &keyArena{initial: size, size: size}
+	}
+}
+
+// WithExpectedKeyLen hints that keys are typically n bytes long, e.g. for
+// fixed-width IDs.  It is advisory and has no effect on results: with
+// WithKeyArena, the first chunk is sized to hold the keys of a full stream,
+// up to the maximum chunk size, so that filling the stream does not grow the
+// arena chunk by chunk.  Without an arena it has no effect.
+func WithExpectedKeyLen(n int) Option {
+	return func(s *Stream) {
+		s.keyLen = n
+	}
+}
+
+// keyArena stores key bytes in chunks that are never modified once written
+type keyArena struct {
+	chunk   []byte
+	initial int // size of the first chunk
+	size    int // size of the next chunk
+}
+
+// alloc returns a copy of x stored in the arena
+func (a *keyArena) alloc(x string) string {
+	if len(x) == 0 {
+		return ""
+	}
+	if len(x) > a.size {
+		return string([]byte(x))
+	}
+	if cap(a.chunk)-len(a.chunk) < len(x) {
+		a.chunk = make([]byte, 0, a.size)
+		if a.size < maxArenaChunk {
+			a.size *= 2
+		}
+	}
+	off := len(a.chunk)
+	a.chunk = append(a.chunk, x...)
+	return unsafe.String(&a.chunk[off], len(x))
+}
+
+// presize raises the size of the first chunk to hold size bytes, up to the
+// maximum chunk size
+func (a *keyArena) presize(size int) {
+	if size > maxArenaChunk {
+		size = maxArenaChunk
+	}
+	if size > a.initial {
+		a.initial = size
+		if a.chunk == nil {
+			a.size = size
+		}
+	}
+}
+
+// reset starts a new chunk for the next key, leaving the previous chunks to
+// the keys still pointing into them
+func (a *keyArena) reset() {
+	a.chunk = nil
+	a.size = a.initial
+}
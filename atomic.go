@@ -0,0 +1,48 @@
+package topk
+
+import "sync/atomic"
+
+// AtomicStream holds a *Stream that can be replaced atomically, allowing a
+// new Stream to be built in the background and swapped in for readers.
+//
+// Only the swap is atomic: the Stream itself is not safe for concurrent use,
+// and an Insert racing with Store may land in either the old or the new
+// Stream.  Callers must still serialize access to the Stream they Load.
+//
+// The zero value holds a zero Stream, which has an n of 0 and monitors
+// nothing, until Store replaces it.
+type AtomicStream struct {
+	p atomic.Pointer[Stream]
+}
+
+// NewAtomicStream returns an AtomicStream holding s
+func NewAtomicStream(s *Stream) *AtomicStream {
+	as := &AtomicStream{}
+	as.p.Store(s)
+	return as
+}
+
+// Load returns the current Stream
+func (as *AtomicStream) Load() *Stream {
+	if s := as.p.Load(); s != nil {
+		return s
+	}
+	as.p.CompareAndSwap(nil, &Stream{})
+	return as.p.Load()
+}
+
+// Store replaces the current Stream with s
+func (as *AtomicStream) Store(s *Stream) {
+	as.p.Store(s)
+}
+
+// Insert adds an element to the current Stream
+func (as *AtomicStream) Insert(x string, count int) Element {
+	return as.Load().Insert(x, count)
+}
+
+// Keys returns the current estimates for the most frequent elements of the
+// current Stream
+func (as *AtomicStream) Keys() []Element {
+	return as.Load().Keys()
+}
@@ -0,0 +1,208 @@
+package topk
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// EncodeConfig writes the configuration of s without any of its data, to be
+// read with DecodeConfig, e.g. to start matching streams on many workers and
+// merge their data later.  The configuration is written as a msgpack map
+// holding n, the alpha ratio and every option set with a value: the filter
+// layout (WithUint32Alphas, WithoutFilter, WithConservativeUpdate), WithMode,
+// WithCardinality, WithExactCounts, WithoutKeyCopy, WithHits, WithSafeMode,
+// WithZeroCountQuery, WithKeysCache, WithMaxCount, WithRounding,
+// WithRecencyEviction, WithEpochs, WithSortedStorage, WithEvictionLog,
+// WithKeyArena, WithExpectedKeyLen, WithExactAbove and WithWarmup.  The
+// fields are written sorted by name, so equal configurations encode to equal
+// bytes, e.g. to compare or hash them.
+//
+// Options holding functions or shared objects cannot be encoded and must be
+// passed to DecodeConfig again: WithInterner, WithKeyNormalizer,
+// WithCollator, WithAdmitProbability, WithRankTransform, WithListener and
+// WithStore.
+func (s *Stream) EncodeConfig(w io.Writer) error {
+	fields := map[string]interface{}{
+		"n": s.n,
+	}
+	if !s.nofilter {
+		fields["ratio"] = s.ratio()
+	}
+	flags := map[string]bool{
+		"uint32alphas": s.alphas32 != nil,
+		"nofilter":     s.nofilter,
+		"conservative": s.conservative,
+		"cardinality":  s.hll != nil,
+		"exactcounts":  s.exact != nil,
+		"nocopy":       s.nocopy,
+		"hits":         s.hits,
+		"safe":         s.safe,
+		"zeroquery":    s.query0,
+		"keyscache":    s.cacheKeys,
+		"recency":      s.k.recency,
+		"epochs":       s.k.epochs,
+		"sorted":       s.k.sorted,
+	}
+	for k, v := range flags {
+		if v {
+			fields[k] = true
+		}
+	}
+	if s.mode != Additive {
+		fields["mode"] = int(s.mode)
+	}
+	if s.rounding != RoundHalfUp {
+		fields["rounding"] = int(s.rounding)
+	}
+	if s.maxCount > 0 {
+		fields["maxcount"] = s.maxCount
+	}
+	if s.evicted != nil {
+		fields["evictionlog"] = len(s.evicted.buf)
+	}
+	if s.arena != nil {
+		fields["arena"] = s.arena.initial
+	}
+	if s.keyLen > 0 {
+		fields["expectedkeylen"] = s.keyLen
+	}
+	if s.promoted != nil && s.promoteAt > 0 {
+		fields["exactabove"] = []interface{}{s.promoteAt, s.maxPromoted}
+	}
+	if s.warm != nil {
+		fields["warmup"] = s.warm.size
+	}
+
+	// write the fields in a fixed order, so that equal configurations
+	// encode to equal bytes
+	names := make([]string, 0, len(fields))
+	for k := range fields {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	wrt := msgp.NewWriter(w)
+	if err := wrt.WriteMapHeader(uint32(len(names))); err != nil {
+		return err
+	}
+	for _, k := range names {
+		if err := wrt.WriteString(k); err != nil {
+			return err
+		}
+		if err := wrt.WriteIntf(fields[k]); err != nil {
+			return err
+		}
+	}
+	return wrt.Flush()
+}
+
+// DecodeConfig returns a new empty Stream with the configuration written by
+// EncodeConfig.  opts are applied after the decoded configuration, to supply
+// the options that cannot be encoded.  Fields written by newer versions are
+// ignored.  It returns an error wrapping ErrInvalidN if n or the filter it
+// implies is negative or too large to allocate, and ErrInconsistent for
+// other fields out of range.
+func DecodeConfig(r io.Reader, opts ...Option) (*Stream, error) {
+	fields := make(map[string]interface{})
+	err := msgp.NewReader(r).ReadMapStrIntf(fields)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, fmt.Errorf("%w: %w", ErrTruncated, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	n, ok := configInt(fields, "n")
+	if !ok || n < 0 || n > maxDecodedN {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidN, fields["n"])
+	}
+
+	var config []Option
+	if ratio, ok := configInt(fields, "ratio"); ok {
+		if ratio <= 0 || n > 0 && ratio > maxDecodedN*alphaRatio/n {
+			return nil, fmt.Errorf("%w: alpha ratio %d for %d", ErrInvalidN, ratio, n)
+		}
+		config = append(config, WithAlphaRatio(ratio))
+	}
+	flags := []struct {
+		name string
+		opt  Option
+	}{
+		{"uint32alphas", WithUint32Alphas()},
+		{"nofilter", WithoutFilter()},
+		{"conservative", WithConservativeUpdate()},
+		{"cardinality", WithCardinality()},
+		{"exactcounts", WithExactCounts()},
+		{"nocopy", WithoutKeyCopy()},
+		{"hits", WithHits()},
+		{"safe", WithSafeMode()},
+		{"zeroquery", WithZeroCountQuery()},
+		{"keyscache", WithKeysCache()},
+		{"recency", WithRecencyEviction()},
+		{"epochs", WithEpochs()},
+		{"sorted", WithSortedStorage()},
+	}
+	for _, f := range flags {
+		if v, _ := fields[f.name].(bool); v {
+			config = append(config, f.opt)
+		}
+	}
+	ints := []struct {
+		name string
+		max  int
+		opt  func(int) Option
+	}{
+		{"mode", int(Signed), func(v int) Option { return WithMode(Mode(v)) }},
+		{"rounding", int(RoundCeil), func(v int) Option { return WithRounding(Rounding(v)) }},
+		{"maxcount", math.MaxInt, WithMaxCount},
+		{"evictionlog", maxDecodedN, WithEvictionLog},
+		{"arena", maxDecodedN, WithKeyArena},
+		{"expectedkeylen", maxDecodedN, WithExpectedKeyLen},
+		{"warmup", maxDecodedN, WithWarmup},
+	}
+	for _, f := range ints {
+		v, ok := configInt(fields, f.name)
+		if !ok {
+			continue
+		}
+		if v < 0 || v > f.max {
+			return nil, fmt.Errorf("%w: %s %d", ErrInconsistent, f.name, v)
+		}
+		config = append(config, f.opt(v))
+	}
+	if v, ok := fields["exactabove"].([]interface{}); ok && len(v) == 2 {
+		threshold, ok1 := configValue(v[0])
+		max, ok2 := configValue(v[1])
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("%w: exact above %v", ErrInconsistent, v)
+		}
+		config = append(config, WithExactAbove(threshold, max))
+	}
+
+	return New(n, append(config, opts...)...), nil
+}
+
+// configInt returns the integer field name of a decoded configuration
+func configInt(fields map[string]interface{}, name string) (int, bool) {
+	v, ok := fields[name]
+	if !ok {
+		return 0, false
+	}
+	return configValue(v)
+}
+
+// configValue returns v as an int, if it is an integer
+func configValue(v interface{}) (int, bool) {
+	switch v := v.(type) {
+	case int64:
+		return int(v), true
+	case uint64:
+		return int(v), true
+	}
+	return 0, false
+}
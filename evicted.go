@@ -0,0 +1,59 @@
+package topk
+
+// WithEvictionLog keeps the last size elements evicted from the stream in a
+// ring buffer, to be read with EvictedSince.  Once size evictions are
+// buffered, each new one overwrites the oldest, so memory stays bounded at
+// size elements however fast keys churn.  A size of 0 or less disables the
+// log, which is the default.
+func WithEvictionLog(size int) Option {
+	return func(s *Stream) {
+		if size <= 0 {
+			s.evicted = nil
+			return
+		}
+		s.evicted = &evictionLog{buf: make([]Element, size)}
+	}
+}
+
+// evictionLog is a ring buffer of evicted elements
+type evictionLog struct {
+	buf  []Element
+	next int // index of the next write
+	len  int // number of buffered elements
+}
+
+func (l *evictionLog) add(e Element) {
+	l.buf[l.next] = Element{Key: e.Key, Count: e.Count, Error: e.Error, Value: e.Value, Hits: e.Hits, FirstSeen: e.FirstSeen, LastSeen: e.LastSeen}
+	l.next = (l.next + 1) % len(l.buf)
+	if l.len < len(l.buf) {
+		l.len++
+	}
+}
+
+func (l *evictionLog) drain() []Element {
+	if l.len == 0 {
+		return nil
+	}
+
+	elts := make([]Element, l.len)
+	start := l.next - l.len + len(l.buf)
+	for i := range elts {
+		elts[i] = l.buf[(start+i)%len(l.buf)]
+	}
+
+	// release the keys
+	clear(l.buf)
+	l.len = 0
+	return elts
+}
+
+// EvictedSince returns the elements evicted since the previous call, oldest
+// first, with their Count and Error at eviction, and empties the log.  Only
+// the last evictions up to the size given to WithEvictionLog are returned;
+// it returns nil if the stream was created without it.
+func (s *Stream) EvictedSince() []Element {
+	if s.evicted == nil {
+		return nil
+	}
+	return s.evicted.drain()
+}
@@ -0,0 +1,63 @@
+package topk
+
+import (
+	"math"
+	"math/bits"
+)
+
+const (
+	hllPrecision = 14
+	hllRegisters = 1 << hllPrecision
+)
+
+// hll is a minimal HyperLogLog sketch estimating the number of distinct keys
+// inserted into a Stream.  It reuses the key hashes computed by Insert.
+type hll []uint8
+
+func newHLL() hll {
+	return make(hll, hllRegisters)
+}
+
+func (h hll) insert(x uint64) {
+	i := x >> (64 - hllPrecision)
+	rho := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rho > h[i] {
+		h[i] = rho
+	}
+}
+
+func (h hll) merge(other hll) {
+	for i, v := range other {
+		if v > h[i] {
+			h[i] = v
+		}
+	}
+}
+
+func (h hll) reset() {
+	for i := range h {
+		h[i] = 0
+	}
+}
+
+func (h hll) estimate() uint64 {
+	m := float64(len(h))
+
+	var (
+		sum   float64
+		zeros int
+	)
+	for _, v := range h {
+		sum += math.Ldexp(1, -int(v))
+		if v == 0 {
+			zeros++
+		}
+	}
+
+	est := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if est <= 2.5*m && zeros > 0 {
+		// small range correction
+		est = m * math.Log(m/float64(zeros))
+	}
+	return uint64(est + 0.5)
+}
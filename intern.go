@@ -0,0 +1,58 @@
+package topk
+
+import (
+	"strings"
+	"sync"
+)
+
+// Interner deduplicates key strings, so that streams sharing it store a
+// single copy of each key they monitor, including across merges and windows.
+//
+// An Interner is safe for concurrent use by streams in different goroutines;
+// lookups are serialized by a mutex.  Interned strings are never released, so
+// an Interner grows with the number of distinct keys ever admitted and should
+// be replaced (or Reset once no stream uses it) when keys churn.
+type Interner struct {
+	mu      sync.Mutex
+	strings map[string]string
+}
+
+// NewInterner returns an empty Interner
+func NewInterner() *Interner {
+	return &Interner{strings: make(map[string]string)}
+}
+
+// Intern returns the canonical copy of s
+func (in *Interner) Intern(s string) string {
+	return in.intern(s, false)
+}
+
+// intern returns the canonical copy of s, storing a copy of s rather than s
+// itself if it is new and clone is set
+func (in *Interner) intern(s string, clone bool) string {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if c, ok := in.strings[s]; ok {
+		return c
+	}
+	if clone {
+		s = strings.Clone(s)
+	}
+	in.strings[s] = s
+	return s
+}
+
+// Len returns the number of interned strings
+func (in *Interner) Len() int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return len(in.strings)
+}
+
+// Reset drops all interned strings
+func (in *Interner) Reset() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.strings = make(map[string]string)
+}
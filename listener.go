@@ -0,0 +1,50 @@
+package topk
+
+// Listener is notified of how each insert changed the stream, e.g. to emit
+// metrics on admissions and evictions.  Each method receives the estimate of
+// the inserted key after the insert, as returned by Insert, and the count
+// inserted.  A LockedStream calls its Listener after releasing its lock, so
+// concurrent inserts call the methods concurrently, in no particular order:
+// implementations used with a LockedStream must be safe for concurrent use.
+type Listener interface {
+	// OnAdmit is called when an unmonitored key is admitted, either into
+	// free space or by replacing the minimum element
+	OnAdmit(e Element, count int)
+	// OnEvict is called with the last estimate of an element evicted by
+	// an admission, before OnAdmit is called for the admitted key
+	OnEvict(evicted Element)
+	// OnFilter is called when an unmonitored key is not admitted and is
+	// counted in the alpha filter instead
+	OnFilter(e Element, count int)
+	// OnUpdate is called when a monitored key is counted
+	OnUpdate(e Element, count int)
+}
+
+// WithListener notifies l of every insert, including those by InsertValue,
+// InsertReplace, InsertClassified, Update and Set; elements added by Merge,
+// InsertElement or decoding are not reported.  Set reports the change of a
+// monitored Count, and Update a negative count of a monitored key, as the
+// count of OnUpdate; negative updates of unmonitored keys change nothing and
+// are not reported.  Listener methods are called synchronously after the
+// insert completed, and by LockedStream after its lock was released, so they
+// may read the stream but must not block.  There is no listener by default.
+func WithListener(l Listener) Option {
+	return func(s *Stream) {
+		s.listener = l
+	}
+}
+
+// notify reports an insert counted with the given admission to the listener
+func (s *Stream) notify(e, evicted Element, a Admission, count int) {
+	switch a {
+	case Tracked:
+		s.listener.OnUpdate(e, count)
+	case Admitted:
+		s.listener.OnAdmit(e, count)
+	case Filtered:
+		s.listener.OnFilter(e, count)
+	case Replaced:
+		s.listener.OnEvict(evicted)
+		s.listener.OnAdmit(e, count)
+	}
+}
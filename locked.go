@@ -0,0 +1,142 @@
+package topk
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LockedStream is a Stream that is safe for concurrent use.
+//
+// Every method takes the lock, including those rebuilding the alpha filter,
+// so readers never observe a filter that is partially rebuilt.
+//
+// Besides the locked Keys and Stats, it can publish snapshots that readers
+// access without taking the lock: Refresh copies the monitored elements under
+// a brief lock and sorts them outside of it, so frequent pollers reading
+// SnapshotKeys and SnapshotStats do not hold off inserts for a sort.
+type LockedStream struct {
+	mu sync.RWMutex
+	s  *Stream
+
+	snap atomic.Pointer[snapshot]
+}
+
+type snapshot struct {
+	keys  []Element
+	stats Stats
+}
+
+// NewLocked returns a LockedStream estimating the top n most frequent elements
+func NewLocked(n int, opts ...Option) *LockedStream {
+	ls := &LockedStream{s: New(n, opts...)}
+	ls.snap.Store(&snapshot{stats: ls.s.Stats()})
+	return ls
+}
+
+// Insert adds an element to the stream to be tracked
+func (ls *LockedStream) Insert(x string, count int) Element {
+	ls.mu.Lock()
+	e, evicted, a := ls.s.record(ls.s.normalize(x), count, 0)
+	ls.mu.Unlock()
+
+	// notify outside the lock, so listeners may read the stream
+	if ls.s.listener != nil {
+		ls.s.notify(e, evicted, a, count)
+	}
+	return e
+}
+
+// Estimate returns an estimate for the item x
+func (ls *LockedStream) Estimate(x string) Element {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+	return ls.s.Estimate(x)
+}
+
+// Query returns everything known about x, as Stream.Query does
+func (ls *LockedStream) Query(x string) QueryResult {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+	return ls.s.Query(x)
+}
+
+// Keys returns the current estimates for the most frequent elements.  Since
+// concurrent readers share the read lock, they do not use the cache of
+// WithKeysCache; frequent pollers should use SnapshotKeys instead.
+func (ls *LockedStream) Keys() []Element {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+	return ls.s.sortedKeys()
+}
+
+// KeysAndTotal returns Keys along with the sum of all inserted counts, read
+// under one lock so that no insert lands between them
+func (ls *LockedStream) KeysAndTotal() ([]Element, int64) {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+	return ls.s.sortedKeys(), ls.s.total
+}
+
+// Stats returns a summary of the stream
+func (ls *LockedStream) Stats() Stats {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+	return ls.s.Stats()
+}
+
+// ResetN reinitializes the stream to estimate the top newN most frequent
+// elements, as Stream.ResetN does.  The alpha filter is rebuilt under the
+// write lock, so concurrent readers observe either the old or the new filter
+// and never a partially reset one.
+func (ls *LockedStream) ResetN(newN int) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.s.ResetN(newN)
+}
+
+// Refresh publishes a new snapshot for SnapshotKeys and SnapshotStats.  The
+// lock is only held while copying the monitored elements.
+func (ls *LockedStream) Refresh() {
+	ls.mu.RLock()
+	elts := append([]Element(nil), ls.s.elements()...)
+	n, total, inserts := ls.s.n, ls.s.total, ls.s.inserts
+	ls.mu.RUnlock()
+
+	st := statsOf(n, total, inserts, elts)
+	ls.s.sortElements(elts)
+	ls.snap.Store(&snapshot{keys: elts, stats: st})
+}
+
+// RefreshEvery calls Refresh every d in a new goroutine until stop is called.
+// Snapshots are then at most d plus the time taken by Refresh out of date.
+func (ls *LockedStream) RefreshEvery(d time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(d)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				ls.Refresh()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// SnapshotKeys returns the most frequent elements as of the last Refresh,
+// without taking the lock.  It is empty before the first Refresh.
+func (ls *LockedStream) SnapshotKeys() []Element {
+	return append([]Element(nil), ls.snap.Load().keys...)
+}
+
+// SnapshotStats returns the summary of the stream as of the last Refresh,
+// without taking the lock
+func (ls *LockedStream) SnapshotStats() Stats {
+	return ls.snap.Load().stats
+}
@@ -0,0 +1,188 @@
+package topk
+
+import (
+	"fmt"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// WithExactAbove tracks keys exactly once their guaranteed count, Count-Error,
+// reaches threshold, so that estimation error alone never promotes a key.
+// Such keys are promoted out of the approximate heap into a side map where
+// they are never evicted, and from then on each insert is counted exactly:
+// a promoted element keeps the Error it had when promoted, but its Count
+// grows by exactly the inserted counts.  The heap keeps its n slots for the
+// remaining keys.  Keys, Estimate and their variants include the promoted
+// elements, so Keys may return more than n elements.  Sample only draws from
+// the heap.
+//
+// At most max keys are promoted.  Once the cap is reached, further keys
+// crossing the threshold stay in the heap and are estimated as usual, so a
+// threshold set too low degrades to plain top-k rather than growing without
+// bound.  Merge keeps the promoted keys of both streams, which may exceed the
+// cap.
+func WithExactAbove(threshold, max int) Option {
+	return func(s *Stream) {
+		s.promoteAt, s.maxPromoted = threshold, max
+		s.promoted = make(map[string]Element)
+	}
+}
+
+// promote moves x from the heap to the promoted elements if its guaranteed
+// count reached the threshold and the cap allows it
+func (s *Stream) promote(x string) {
+	if s.promoteAt <= 0 || len(s.promoted) >= s.maxPromoted {
+		return
+	}
+	if s.store != nil {
+		// the epoch of x is kept in sideEpochs either way
+		if e, ok := s.store.Get(x); ok && e.Count-e.Error >= s.promoteAt {
+			s.store.Delete(x)
+			s.promoted[x] = e
+		}
+		return
+	}
+	idx, ok := s.k.m[x]
+	if !ok || s.k.elts[idx].Count-s.k.elts[idx].Error < s.promoteAt {
+		return
+	}
+	e, st := s.k.remove(idx)
+	s.promoted[x] = e
+	s.setSideEpoch(x, st.epoch)
+}
+
+// touchSide stamps the element x outside the heap with the current epoch
+func (s *Stream) touchSide(x string) {
+	s.setSideEpoch(x, s.k.now().epoch)
+}
+
+// setSideEpoch records epoch as the epoch of the last update of the element
+// x outside the heap
+func (s *Stream) setSideEpoch(x string, epoch uint64) {
+	if s.sideEpochs == nil {
+		if epoch == 0 {
+			return
+		}
+		s.sideEpochs = make(map[string]uint64)
+	}
+	s.sideEpochs[x] = epoch
+}
+
+// elements returns the monitored elements in the heap or store followed by the
+// promoted ones, for reading only
+func (s *Stream) elements() []Element {
+	elts := s.k.elts
+	if s.store != nil {
+		elts = s.storeElements()
+	}
+	if len(s.promoted) == 0 {
+		return elts
+	}
+	elts = append(make([]Element, 0, len(elts)+len(s.promoted)), elts...)
+	for _, e := range s.promoted {
+		elts = append(elts, e)
+	}
+	return elts
+}
+
+// addPromoted adds e, last updated in epoch, to the promoted element of the
+// same key, or promotes it
+func (s *Stream) addPromoted(e Element, epoch uint64) {
+	if s.promoted == nil {
+		s.promoted = make(map[string]Element)
+	}
+	if p, ok := s.promoted[e.Key]; ok {
+		e.Count += p.Count
+		e.Error += p.Error
+		e.Value += p.Value
+		e.Hits += p.Hits
+		e.addSeen(p)
+		epoch = max(epoch, s.sideEpochs[e.Key])
+	}
+	s.promoted[e.Key] = e
+	s.setSideEpoch(e.Key, epoch)
+}
+
+// encodePromoted writes the promoted elements as an array of key, count,
+// error, value, hits, first seen and last seen arrays
+func (s *Stream) encodePromoted(w *msgp.Writer) error {
+	if err := w.WriteArrayHeader(uint32(len(s.promoted))); err != nil {
+		return err
+	}
+	for _, e := range s.promoted {
+		if err := w.WriteArrayHeader(7); err != nil {
+			return err
+		}
+		if err := w.WriteString(e.Key); err != nil {
+			return err
+		}
+		if err := w.WriteInt(e.Count); err != nil {
+			return err
+		}
+		if err := w.WriteInt(e.Error); err != nil {
+			return err
+		}
+		if err := w.WriteInt64(e.Value); err != nil {
+			return err
+		}
+		if err := w.WriteInt64(e.Hits); err != nil {
+			return err
+		}
+		if err := w.WriteInt64(e.FirstSeen); err != nil {
+			return err
+		}
+		if err := w.WriteInt64(e.LastSeen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Stream) decodePromoted(r *msgp.Reader) error {
+	sz, err := r.ReadArrayHeader()
+	if err != nil {
+		return err
+	}
+	s.promoted = make(map[string]Element, sz)
+	for i := uint32(0); i < sz; i++ {
+		fields, err := r.ReadArrayHeader()
+		if err != nil {
+			return err
+		}
+		// hits and then observation times were added as further fields
+		if fields != 4 && fields != 5 && fields != 7 {
+			return fmt.Errorf("%w: promoted element of %d fields", ErrInconsistent, fields)
+		}
+		var e Element
+		if e.Key, err = r.ReadString(); err != nil {
+			return err
+		}
+		if e.Count, err = r.ReadInt(); err != nil {
+			return err
+		}
+		if e.Error, err = r.ReadInt(); err != nil {
+			return err
+		}
+		if e.Value, err = r.ReadInt64(); err != nil {
+			return err
+		}
+		if fields >= 5 {
+			if e.Hits, err = r.ReadInt64(); err != nil {
+				return err
+			}
+		}
+		if fields == 7 {
+			if e.FirstSeen, err = r.ReadInt64(); err != nil {
+				return err
+			}
+			if e.LastSeen, err = r.ReadInt64(); err != nil {
+				return err
+			}
+		}
+		if _, ok := s.k.m[e.Key]; ok {
+			return fmt.Errorf("%w: key %q both promoted and in the heap", ErrInconsistent, e.Key)
+		}
+		s.promoted[e.Key] = e
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package topk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// WriteRecords writes the top m elements to w in the same order as Keys, each
+// as a separate record: a 4-byte big-endian length followed by that many
+// bytes of msgp, an array of key, count and error.  Unlike Encode, each
+// record can be consumed on its own, e.g. as a message on a queue.
+func (s *Stream) WriteRecords(w io.Writer, m int) error {
+	elts, idx := s.topIndex(m)
+	var buf []byte
+	for _, j := range idx {
+		buf = appendRecord(buf[:0], elts[j])
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendRecord(b []byte, e Element) []byte {
+	b = append(b, 0, 0, 0, 0)
+	b = msgp.AppendArrayHeader(b, 3)
+	b = msgp.AppendString(b, e.Key)
+	b = msgp.AppendInt(b, e.Count)
+	b = msgp.AppendInt(b, e.Error)
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	return b
+}
+
+// ReadRecords reads the records written by WriteRecords from r, calling fn
+// for each element in turn.  It returns nil at the end of r, the first error
+// returned by fn, or an error wrapping ErrTruncated if r ends within a record.
+func ReadRecords(r io.Reader, fn func(Element) error) error {
+	var (
+		hdr [4]byte
+		buf []byte
+	)
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("%w: %w", ErrTruncated, err)
+		}
+
+		sz := binary.BigEndian.Uint32(hdr[:])
+		if cap(buf) < int(sz) {
+			buf = make([]byte, sz)
+		}
+		buf = buf[:sz]
+		if _, err := io.ReadFull(r, buf); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("%w: %w", ErrTruncated, err)
+		}
+
+		e, err := decodeRecord(buf)
+		if err != nil {
+			return err
+		}
+		if err = fn(e); err != nil {
+			return err
+		}
+	}
+}
+
+func decodeRecord(b []byte) (Element, error) {
+	var e Element
+	sz, b, err := msgp.ReadArrayHeaderBytes(b)
+	if err != nil {
+		return e, err
+	}
+	if sz != 3 {
+		return e, fmt.Errorf("%w: record of %d fields", ErrInconsistent, sz)
+	}
+	if e.Key, b, err = msgp.ReadStringBytes(b); err != nil {
+		return e, err
+	}
+	if e.Count, b, err = msgp.ReadIntBytes(b); err != nil {
+		return e, err
+	}
+	if e.Error, b, err = msgp.ReadIntBytes(b); err != nil {
+		return e, err
+	}
+	if len(b) != 0 {
+		return e, fmt.Errorf("%w: %d trailing bytes in record", ErrInconsistent, len(b))
+	}
+	return e, nil
+}
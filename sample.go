@@ -0,0 +1,41 @@
+package topk
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// Sample returns a monitored key chosen with probability proportional to its
+// estimated count.  It returns false if there is nothing to sample from.
+//
+// Sampling is O(log n) using a cumulative distribution of the counts, which is
+// rebuilt on the first call after the monitored elements change, or on every
+// call for a stream created WithStore, whose elements may be listed in a
+// different order each time.
+func (s *Stream) Sample(rng *rand.Rand) (string, bool) {
+	elts, cdf := s.k.elts, s.cdf
+	if s.store != nil {
+		elts, cdf = s.storeElements(), nil
+	}
+	if cdf == nil {
+		cdf = make([]int, len(elts))
+		total := 0
+		for i, e := range elts {
+			if e.Count > 0 {
+				total += e.Count
+			}
+			cdf[i] = total
+		}
+		if s.store == nil {
+			s.cdf = cdf
+		}
+	}
+
+	if len(cdf) == 0 || cdf[len(cdf)-1] == 0 {
+		return "", false
+	}
+
+	r := int(rng.Int63n(int64(cdf[len(cdf)-1])))
+	i := sort.Search(len(cdf), func(i int) bool { return cdf[i] > r })
+	return elts[i].Key, true
+}
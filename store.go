@@ -0,0 +1,296 @@
+package topk
+
+import (
+	"errors"
+
+	"github.com/dgryski/go-metro"
+)
+
+// ErrStore is returned by WalkHeap for a stream created WithStore, which
+// keeps its elements in the Store rather than a heap
+var ErrStore = errors.New("topk: no heap with a Store")
+
+// Store holds the monitored elements of a Stream, so that they can be kept
+// in an alternative structure, e.g. on disk or in a memory-mapped file, for
+// very large n.  By default a Stream keeps them in an in-memory heap indexed
+// by a map; NewHeapStore returns that structure behind this interface as a
+// reference implementation.
+//
+// A Store must hold at most one element per key, and the Stream never holds
+// more elements than its n.  Elements passed to the Store are owned by it
+// and must be returned unchanged.  A Store is only accessed under the same
+// synchronization as the Stream using it, and is not modified while Each
+// runs.
+type Store interface {
+	// Len returns the number of monitored elements
+	Len() int
+	// Get returns the element monitored for key, or false if key is not
+	// monitored
+	Get(key string) (Element, bool)
+	// Set stores e as the element for e.Key, replacing the one monitored
+	// for that key or adding it if the key is not monitored
+	Set(e Element)
+	// Min returns the element with the lowest Count, the one to be evicted
+	// next, or false if the store is empty.  Among equal counts the one with
+	// the largest Error should be returned, as the default heap does.
+	Min() (Element, bool)
+	// Replace removes the element returned by Min, stores e in its place and
+	// returns the removed element.  It is only called on a non-empty store.
+	Replace(e Element) Element
+	// Each calls fn for every monitored element, in any order, until fn
+	// returns false
+	Each(fn func(e Element) bool)
+	// Delete removes the element monitored for key, if any
+	Delete(key string)
+}
+
+// WithStore keeps the monitored elements in store instead of the default
+// in-memory heap.  store must be empty.
+//
+// Methods reading or updating single keys, such as Insert, Set, Estimate and
+// Query, and those listing the monitored elements, such as Keys and Stats,
+// call the store directly.  Methods rebuilding or serializing all monitored
+// elements at once, such as Merge, Scale, TrimToTop, Encode and Decode, move
+// them into an in-memory heap for their duration and back into the store.
+// The store decides which element is evicted through Min, so the options
+// ordering the default heap, WithRecencyEviction, WithSortedStorage and
+// WithRankTransform, have no effect on it, and WalkHeap returns ErrStore.
+func WithStore(store Store) Option {
+	return func(s *Stream) {
+		s.store = store
+	}
+}
+
+// recordStore counts x in the store as count does in the default heap
+func (s *Stream) recordStore(x string, xhash uint64, count int, value, hit int64) (Element, Element, Admission) {
+	if e, ok := s.store.Get(x); ok {
+		e.Count += count
+		e.Value += value
+		e.Hits += hit
+		s.clamp(&e)
+		s.store.Set(e)
+		s.touchSide(x)
+		s.promote(x)
+		return e, Element{}, Tracked
+	}
+
+	if s.store.Len() < s.n {
+		e := Element{Key: s.intern(x), Count: count, Value: value, Hits: hit}
+		s.clamp(&e)
+		s.store.Set(e)
+		s.touchSide(e.Key)
+		s.promote(e.Key)
+		return e, Element{}, Admitted
+	}
+
+	minElement, ok := s.store.Min()
+	if alpha := s.alpha(xhash); !ok || alpha+count < minElement.Count || !s.admit() {
+		s.setAlpha(xhash, alpha+count)
+		return Element{Key: x, Error: alpha, Count: alpha + count}, Element{}, Filtered
+	}
+
+	s.setAlpha(metro.Hash64Str(minElement.Key, 0), minElement.Count)
+	alpha := s.alpha(xhash)
+	e := Element{
+		Key:   s.intern(x),
+		Error: alpha,
+		Count: alpha + count,
+		Value: value,
+		Hits:  hit,
+	}
+	s.clamp(&e)
+	evicted := s.store.Replace(e)
+	delete(s.sideEpochs, evicted.Key)
+	s.touchSide(e.Key)
+	if s.evicted != nil {
+		s.evicted.add(evicted)
+	}
+	s.promote(e.Key)
+	return e, evicted, Replaced
+}
+
+// insertStore adds e to the store as InsertElement does to the default heap
+func (s *Stream) insertStore(e Element, xhash uint64) Element {
+	if p, ok := s.store.Get(e.Key); ok {
+		p.Count += e.Count
+		p.Error += e.Error
+		p.Value += e.Value
+		p.Hits += e.Hits
+		p.addSeen(e)
+		s.clamp(&p)
+		s.store.Set(p)
+		s.touchSide(p.Key)
+		return p
+	}
+
+	if s.store.Len() < s.n {
+		e.Key = s.intern(e.Key)
+		s.clamp(&e)
+		s.store.Set(e)
+		s.touchSide(e.Key)
+		return e
+	}
+
+	minElement, ok := s.store.Min()
+	if alpha := s.alpha(xhash); !ok || alpha+e.Count < minElement.Count {
+		s.setAlpha(xhash, alpha+e.Count)
+		return Element{Key: e.Key, Count: alpha + e.Count, Error: alpha}
+	}
+
+	e.Key = s.intern(e.Key)
+	s.clamp(&e)
+	s.setAlpha(metro.Hash64Str(minElement.Key, 0), minElement.Count)
+	evicted := s.store.Replace(e)
+	delete(s.sideEpochs, evicted.Key)
+	s.touchSide(e.Key)
+	if s.evicted != nil {
+		s.evicted.add(evicted)
+	}
+	return e
+}
+
+// storeElements returns the elements of the store
+func (s *Stream) storeElements() []Element {
+	return elementsOf(s.store)
+}
+
+func elementsOf(store Store) []Element {
+	elts := make([]Element, 0, store.Len())
+	store.Each(func(e Element) bool {
+		elts = append(elts, e)
+		return true
+	})
+	return elts
+}
+
+// size returns the number of elements in the heap or store, which excludes
+// the promoted ones
+func (s *Stream) size() int {
+	if s.store != nil {
+		return s.store.Len()
+	}
+	return len(s.k.elts)
+}
+
+// min returns the element in the heap or store to be evicted next, or false
+// if there is none
+func (s *Stream) min() (Element, bool) {
+	if s.store != nil {
+		return s.store.Min()
+	}
+	if len(s.k.elts) == 0 {
+		return Element{}, false
+	}
+	return s.k.elts[0], true
+}
+
+// clearStore deletes all elements of the store
+func (s *Stream) clearStore() {
+	for _, e := range s.storeElements() {
+		s.store.Delete(e.Key)
+		delete(s.sideEpochs, e.Key)
+	}
+}
+
+// viaHeap runs fn with the elements of the store moved into the heap, for the
+// operations that rebuild or serialize all monitored elements at once, and
+// moves the elements fn leaves in the heap back into the store.  fn sees a
+// stream with the default heap.
+func (s *Stream) viaHeap(fn func()) {
+	store := s.store
+	s.store = nil
+	for _, e := range elementsOf(store) {
+		store.Delete(e.Key)
+		s.k.push(e, stamp{epoch: s.sideEpochs[e.Key]})
+		delete(s.sideEpochs, e.Key)
+	}
+	defer s.storeHeap(store)
+	fn()
+}
+
+// storeHeap moves the elements of the heap into store and uses it for s
+func (s *Stream) storeHeap(store Store) {
+	for i, e := range s.k.elts {
+		store.Set(e)
+		s.setSideEpoch(e.Key, s.k.stamps[i].epoch)
+	}
+	s.k = s.k.empty(0)
+	s.store = store
+}
+
+// heapCopy returns a shallow copy of s holding the elements of its store in
+// its own heap, to read them as those of the default heap, e.g. to encode or
+// merge from s.  Warm-up must have ended.
+func (s *Stream) heapCopy() *Stream {
+	c := *s
+	c.store = nil
+	c.k = s.k.empty(s.store.Len())
+	s.store.Each(func(e Element) bool {
+		c.k.push(e, stamp{epoch: s.sideEpochs[e.Key]})
+		return true
+	})
+	return &c
+}
+
+// heapStore is the default heap behind the Store interface
+type heapStore struct {
+	k keys
+}
+
+// NewHeapStore returns an empty Store keeping up to n elements in an
+// in-memory heap indexed by a map, as a Stream does by default
+func NewHeapStore(n int) Store {
+	return &heapStore{k: newKeys(n)}
+}
+
+func (h *heapStore) Len() int {
+	return len(h.k.elts)
+}
+
+func (h *heapStore) Get(key string) (Element, bool) {
+	idx, ok := h.k.m[key]
+	if !ok {
+		return Element{}, false
+	}
+	return h.k.elts[idx], true
+}
+
+func (h *heapStore) Set(e Element) {
+	idx, ok := h.k.m[e.Key]
+	if !ok {
+		h.k.push(e, stamp{})
+		return
+	}
+	h.k.elts[idx] = e
+	h.k.fix(idx)
+}
+
+func (h *heapStore) Min() (Element, bool) {
+	if len(h.k.elts) == 0 {
+		return Element{}, false
+	}
+	return h.k.elts[0], true
+}
+
+func (h *heapStore) Replace(e Element) Element {
+	old := h.k.elts[0]
+	delete(h.k.m, old.Key)
+	h.k.elts[0], h.k.stamps[0] = e, stamp{}
+	h.k.m[e.Key] = 0
+	h.k.fix(0)
+	return old
+}
+
+func (h *heapStore) Each(fn func(e Element) bool) {
+	for _, e := range h.k.elts {
+		if !fn(e) {
+			return
+		}
+	}
+}
+
+func (h *heapStore) Delete(key string) {
+	if idx, ok := h.k.m[key]; ok {
+		h.k.remove(idx)
+	}
+}
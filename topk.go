@@ -18,11 +18,22 @@ Licensed under the MIT license.
 package topk
 
 import (
-	"container/heap"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/bits"
+	"math/rand"
+	"slices"
 	"sort"
+	"strings"
 
+	"github.com/axiomhq/topk/topkpb"
 	"github.com/dgryski/go-metro"
 	"github.com/tinylib/msgp/msgp"
 )
@@ -32,6 +43,31 @@ type Element struct {
 	Key   string `json:"key"`
 	Count int    `json:"count"`
 	Error int    `json:"error"`
+
+	// Value is the sum of the values inserted with InsertValue since the
+	// element was last admitted
+	Value int64 `json:"value,omitempty"`
+
+	// Hits is the number of inserts of the key since the element was last
+	// admitted, regardless of their counts; it is only counted WithHits
+	Hits int64 `json:"hits,omitempty"`
+
+	// FirstSeen and LastSeen are the timestamps passed to InsertAt when the
+	// element was admitted and last updated, or 0 if it was not inserted
+	// with InsertAt
+	FirstSeen int64 `json:"first_seen,omitempty"`
+	LastSeen  int64 `json:"last_seen,omitempty"`
+}
+
+// addSeen merges the observation times of o into e, keeping the earliest
+// FirstSeen and latest LastSeen that are known
+func (e *Element) addSeen(o Element) {
+	if o.FirstSeen != 0 && (e.FirstSeen == 0 || o.FirstSeen < e.FirstSeen) {
+		e.FirstSeen = o.FirstSeen
+	}
+	if o.LastSeen > e.LastSeen {
+		e.LastSeen = o.LastSeen
+	}
 }
 
 type elementsByCountDescending []Element
@@ -42,9 +78,74 @@ func (elts elementsByCountDescending) Less(i, j int) bool {
 }
 func (elts elementsByCountDescending) Swap(i, j int) { elts[i], elts[j] = elts[j], elts[i] }
 
+// keysByCountDescending sorts the elements of a heap as
+// elementsByCountDescending does, moving their stamps along
+type keysByCountDescending struct{ *keys }
+
+func (tk keysByCountDescending) Less(i, j int) bool {
+	return elementsByCountDescending(tk.elts).Less(i, j)
+}
+
+type elementsByKey []Element
+
+func (elts elementsByKey) Len() int           { return len(elts) }
+func (elts elementsByKey) Less(i, j int) bool { return elts[i].Key < elts[j].Key }
+func (elts elementsByKey) Swap(i, j int)      { elts[i], elts[j] = elts[j], elts[i] }
+
+// stamp records when a monitored element was last updated
+type stamp struct {
+	seq   uint64 // last update, for recency-aware eviction
+	epoch uint64 // epoch of the last update, for KeysSince
+}
+
 type keys struct {
 	m    map[string]int
 	elts []Element
+
+	// stamps holds the stamp of each element of elts at the same index
+	stamps []stamp
+
+	// recency breaks ties between equal counts by evicting the least
+	// recently updated element, using the sequence number seq
+	recency bool
+	seq     uint64
+
+	// epochs stamps updated elements with the current epoch
+	epochs bool
+	epoch  uint64
+
+	// sorted keeps elts fully sorted by Less instead of as a heap; a sorted
+	// slice is also a valid heap, so elts[0] is the minimum either way
+	sorted bool
+
+	// rank transforms counts before they are compared, or is nil to
+	// compare counts themselves
+	rank func(count int) float64
+}
+
+// newKeys returns an empty heap with room for n elements
+func newKeys(n int) keys {
+	return keys{
+		m:      make(map[string]int, n),
+		elts:   make([]Element, 0, n),
+		stamps: make([]stamp, 0, n),
+	}
+}
+
+// empty returns an empty heap with room for n elements and the same
+// configuration as tk
+func (tk *keys) empty(n int) keys {
+	return keys{
+		m:       make(map[string]int, n),
+		elts:    make([]Element, 0, n),
+		stamps:  make([]stamp, 0, n),
+		recency: tk.recency,
+		seq:     tk.seq,
+		epochs:  tk.epochs,
+		epoch:   tk.epoch,
+		sorted:  tk.sorted,
+		rank:    tk.rank,
+	}
 }
 
 func (tk *keys) EncodeMsgp(w *msgp.Writer) error {
@@ -78,6 +179,12 @@ func (tk *keys) EncodeMsgp(w *msgp.Writer) error {
 }
 
 func (tk *keys) DecodeMsp(r *msgp.Reader) error {
+	return tk.decodeMsgp(r, false)
+}
+
+// decodeMsgp decodes the heap, reusing the existing index and element
+// capacity if reuse is set
+func (tk *keys) decodeMsgp(r *msgp.Reader, reuse bool) error {
 	var (
 		err error
 		sz  uint32
@@ -87,7 +194,13 @@ func (tk *keys) DecodeMsp(r *msgp.Reader) error {
 		return err
 	}
 
-	tk.m = make(map[string]int, sz)
+	if reuse && tk.m != nil {
+		for k := range tk.m {
+			delete(tk.m, k)
+		}
+	} else {
+		tk.m = make(map[string]int, sz)
+	}
 
 	for i := uint32(0); i < sz; i++ {
 		key, err := r.ReadString()
@@ -101,297 +214,3620 @@ func (tk *keys) DecodeMsp(r *msgp.Reader) error {
 		tk.m[key] = val
 	}
 
-	if sz, err = r.ReadArrayHeader(); err != nil {
+	if err = tk.decodeElements(r, reuse); err != nil {
+		return err
+	}
+	if err = tk.checkIndex(); err != nil {
+		return err
+	}
+
+	// the encoding may come from a stream storing a heap
+	tk.init()
+	return nil
+}
+
+// checkIndex validates that every element is indexed at its own position,
+// which also rules out a repeated key leaving two heap entries sharing one
+// map slot
+func (tk *keys) checkIndex() error {
+	if len(tk.m) != len(tk.elts) {
+		return fmt.Errorf("%w: index has %d keys for %d elements", ErrInconsistent, len(tk.m), len(tk.elts))
+	}
+	for i, e := range tk.elts {
+		if idx, ok := tk.m[e.Key]; !ok || idx != i {
+			return fmt.Errorf("%w: duplicate or unindexed key %q in elements", ErrInconsistent, e.Key)
+		}
+	}
+	return nil
+}
+
+// decodeElements decodes the elements of the heap without its index
+func (tk *keys) decodeElements(r *msgp.Reader, reuse bool) error {
+	sz, err := r.ReadArrayHeader()
+	if err != nil {
 		return err
 	}
 
-	tk.elts = make([]Element, sz)
+	if reuse && uint32(cap(tk.elts)) >= sz && uint32(cap(tk.stamps)) >= sz {
+		tk.elts = tk.elts[:sz]
+		tk.stamps = tk.stamps[:sz]
+		clear(tk.stamps)
+	} else {
+		tk.elts = make([]Element, sz)
+		tk.stamps = make([]stamp, sz)
+	}
 	for i := range tk.elts {
-		if tk.elts[i].Key, err = r.ReadString(); err != nil {
+		var e Element
+		if e.Key, err = r.ReadString(); err != nil {
 			return err
 		}
-		if tk.elts[i].Count, err = r.ReadInt(); err != nil {
+		if e.Count, err = r.ReadInt(); err != nil {
 			return err
 		}
-		if tk.elts[i].Error, err = r.ReadInt(); err != nil {
+		if e.Error, err = r.ReadInt(); err != nil {
 			return err
 		}
+		tk.elts[i] = e
 	}
-
 	return nil
 }
 
-// Implement the container/heap interface
+// keys is a min-heap of the monitored elements.  The heap operations mirror
+// container/heap but operate on concrete types, so elements are not boxed in
+// an interface{} on every push.
+
+// hasValues reports whether any element has a nonzero Value
+func (tk *keys) hasValues() bool {
+	for _, e := range tk.elts {
+		if e.Value != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hasSeen reports whether any element has an observation time
+func (tk *keys) hasSeen() bool {
+	for _, e := range tk.elts {
+		if e.FirstSeen != 0 || e.LastSeen != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hasHits reports whether any element has nonzero Hits
+func (tk *keys) hasHits() bool {
+	for _, e := range tk.elts {
+		if e.Hits != 0 {
+			return true
+		}
+	}
+	return false
+}
 
 // Len ...
 func (tk *keys) Len() int { return len(tk.elts) }
 
 // Less ...
 func (tk *keys) Less(i, j int) bool {
-	return (tk.elts[i].Count < tk.elts[j].Count) || (tk.elts[i].Count == tk.elts[j].Count && tk.elts[i].Error > tk.elts[j].Error)
+	return tk.less(&tk.elts[i], &tk.elts[j], tk.stamps[i].seq, tk.stamps[j].seq)
+}
+
+// less orders a and b, last updated at the sequence numbers aseq and bseq
+func (tk *keys) less(a, b *Element, aseq, bseq uint64) bool {
+	if tk.rank != nil {
+		return tk.rankLess(a, b, aseq, bseq)
+	}
+	if tk.recency && a.Count == b.Count && aseq != bseq {
+		return aseq < bseq
+	}
+	return (a.Count < b.Count) || (a.Count == b.Count && a.Error > b.Error)
 }
+
+// rankLess orders a and b by their transformed counts; elements of equal
+// rank are evicted least recently updated first, if tracked, and otherwise
+// largest Error first, whatever their counts
+func (tk *keys) rankLess(a, b *Element, aseq, bseq uint64) bool {
+	if ra, rb := tk.rank(a.Count), tk.rank(b.Count); ra != rb {
+		return ra < rb
+	}
+	if tk.recency && aseq != bseq {
+		return aseq < bseq
+	}
+	if a.Error != b.Error {
+		return a.Error > b.Error
+	}
+	return a.Count < b.Count
+}
+
 func (tk *keys) Swap(i, j int) {
 
 	tk.elts[i], tk.elts[j] = tk.elts[j], tk.elts[i]
+	tk.stamps[i], tk.stamps[j] = tk.stamps[j], tk.stamps[i]
 
 	tk.m[tk.elts[i].Key] = i
 	tk.m[tk.elts[j].Key] = j
 }
 
-func (tk *keys) Push(x interface{}) {
-	e := x.(Element)
+// now returns the stamp of an element updated now
+func (tk *keys) now() stamp {
+	var st stamp
+	if tk.recency {
+		tk.seq++
+		st.seq = tk.seq
+	}
+	if tk.epochs {
+		st.epoch = tk.epoch
+	}
+	return st
+}
+
+// touch marks the element at index i as the most recently updated
+func (tk *keys) touch(i int) {
+	tk.stamps[i] = tk.now()
+}
+
+// push adds e, last updated at st, to the heap
+func (tk *keys) push(e Element, st stamp) {
 	tk.m[e.Key] = len(tk.elts)
 	tk.elts = append(tk.elts, e)
+	tk.stamps = append(tk.stamps, st)
+	if tk.sorted {
+		tk.settle(len(tk.elts) - 1)
+		return
+	}
+	tk.up(len(tk.elts) - 1)
+}
+
+func (tk *keys) init() {
+	if tk.sorted {
+		// sorting is not stable, so leave sorted elements in place
+		if !sort.IsSorted(tk) {
+			sort.Sort(tk)
+		}
+		return
+	}
+
+	n := len(tk.elts)
+	for i := n/2 - 1; i >= 0; i-- {
+		tk.down(i, n)
+	}
 }
 
-func (tk *keys) Pop() interface{} {
-	var e Element
-	e, tk.elts = tk.elts[len(tk.elts)-1], tk.elts[:len(tk.elts)-1]
+// remove removes the element at index i from the heap and returns it along
+// with its stamp
+func (tk *keys) remove(i int) (Element, stamp) {
+	n := len(tk.elts) - 1
+	if tk.sorted {
+		e, st := tk.elts[i], tk.stamps[i]
+		copy(tk.elts[i:], tk.elts[i+1:])
+		copy(tk.stamps[i:], tk.stamps[i+1:])
+		tk.elts[n] = Element{}
+		tk.elts, tk.stamps = tk.elts[:n], tk.stamps[:n]
+		delete(tk.m, e.Key)
+		tk.reindex(i, n)
+		return e, st
+	}
 
+	if i != n {
+		tk.Swap(i, n)
+	}
+	e, st := tk.elts[n], tk.stamps[n]
+	tk.elts[n] = Element{}
+	tk.elts, tk.stamps = tk.elts[:n], tk.stamps[:n]
 	delete(tk.m, e.Key)
+	if i != n {
+		tk.fix(i)
+	}
+	return e, st
+}
 
-	return e
+func (tk *keys) fix(i int) {
+	if tk.sorted {
+		tk.settle(i)
+		return
+	}
+	if !tk.down(i, len(tk.elts)) {
+		tk.up(i)
+	}
+}
+
+// settle moves the element at index i, whose order changed, to its place in
+// the sorted elements, finding it by binary search and shifting the elements
+// in between
+func (tk *keys) settle(i int) {
+	e, st := tk.elts[i], tk.stamps[i]
+	n := len(tk.elts)
+	switch {
+	case i > 0 && tk.less(&e, &tk.elts[i-1], st.seq, tk.stamps[i-1].seq):
+		j := sort.Search(i, func(j int) bool { return tk.less(&e, &tk.elts[j], st.seq, tk.stamps[j].seq) })
+		copy(tk.elts[j+1:i+1], tk.elts[j:i])
+		copy(tk.stamps[j+1:i+1], tk.stamps[j:i])
+		tk.elts[j], tk.stamps[j] = e, st
+		tk.reindex(j, i+1)
+	case i < n-1 && tk.less(&tk.elts[i+1], &e, tk.stamps[i+1].seq, st.seq):
+		j := i + 1 + sort.Search(n-i-1, func(j int) bool {
+			return !tk.less(&tk.elts[i+1+j], &e, tk.stamps[i+1+j].seq, st.seq)
+		})
+		copy(tk.elts[i:j-1], tk.elts[i+1:j])
+		copy(tk.stamps[i:j-1], tk.stamps[i+1:j])
+		tk.elts[j-1], tk.stamps[j-1] = e, st
+		tk.reindex(i, j)
+	}
+}
+
+// reindex updates the index of the elements in elts[from:to]
+func (tk *keys) reindex(from, to int) {
+	for i := from; i < to; i++ {
+		tk.m[tk.elts[i].Key] = i
+	}
 }
 
+func (tk *keys) up(j int) {
+	for {
+		i := (j - 1) / 2 // parent
+		if i == j || !tk.Less(j, i) {
+			break
+		}
+		tk.Swap(i, j)
+		j = i
+	}
+}
+
+func (tk *keys) down(i0, n int) bool {
+	i := i0
+	for {
+		j1 := 2*i + 1
+		if j1 >= n || j1 < 0 { // j1 < 0 after int overflow
+			break
+		}
+		j := j1 // left child
+		if j2 := j1 + 1; j2 < n && tk.Less(j2, j1) {
+			j = j2 // = 2*i + 2  // right child
+		}
+		if !tk.Less(j, i) {
+			break
+		}
+		tk.Swap(i, j)
+		i = j
+	}
+	return i > i0
+}
+
+// alphaRatio is the multiplicative constant from the paper relating the size
+// of the alpha filter to the number of monitored elements
+const alphaRatio = 6
+
 // Stream calculates the TopK elements for a stream
 type Stream struct {
 	n      int
 	k      keys
 	alphas []int
-}
 
-// New returns a Stream estimating the top n most frequent elements
-func New(n int) *Stream {
-	return &Stream{
-		n:      n,
-		k:      keys{m: make(map[string]int, n), elts: make([]Element, 0, n)},
-		alphas: make([]int, n*6), // 6 is the multiplicative constant from the paper
-	}
-}
+	// alphas32 replaces alphas when the stream was created WithUint32Alphas
+	alphas32 []uint32
 
-func reduce(x uint64, n int) uint32 {
-	return uint32(uint64(uint32(x)) * uint64(n) >> 32)
-}
+	// the filter layout set by options, applied and cleared by New once
+	// all ran
+	filterRatio int
+	narrow      bool
 
-// Insert adds an element to the stream to be tracked
-// It returns an estimation for the just inserted element
-func (s *Stream) Insert(x string, count int) Element {
+	conservative bool
+	nofilter     bool
+	mode         Mode
 
-	xhash := reduce(metro.Hash64Str(x, 0), len(s.alphas))
+	// hll estimates the number of distinct keys, or is nil if disabled
+	hll hll
 
-	// are we tracking this element?
-	if idx, ok := s.k.m[x]; ok {
-		s.k.elts[idx].Count += count
-		e := s.k.elts[idx]
-		heap.Fix(&s.k, idx)
-		return e
-	}
+	total   int64 // sum of all inserted counts
+	inserts int64 // number of inserts
 
-	// can we track more elements?
-	if len(s.k.elts) < s.n {
-		// there is free space
-		e := Element{Key: x, Count: count}
-		heap.Push(&s.k, e)
-		return e
-	}
+	// exact counts every key, for testing; nil unless WithExactCounts
+	exact map[string]int
 
-	if s.alphas[xhash]+count < s.k.elts[0].Count {
-		e := Element{
-			Key:   x,
-			Error: s.alphas[xhash],
-			Count: s.alphas[xhash] + count,
-		}
-		s.alphas[xhash] += count
-		return e
-	}
+	interner *Interner
+	nocopy   bool // store admitted keys without copying them
+	hits     bool // count inserts in Element.Hits
+	safe     bool // validate the heap in InsertChecked
+	query0   bool // treat inserts of a count of 0 as queries
+	maxCount int  // clamp monitored counts at maxCount if positive
 
-	// replace the current minimum element
-	minElement := s.k.elts[0]
+	rounding Rounding
 
-	mkhash := reduce(metro.Hash64Str(minElement.Key, 0), len(s.alphas))
-	s.alphas[mkhash] = minElement.Count
+	// admitP is the probability of admitting a key, drawn from rng, or rng is
+	// nil to always admit
+	admitP float64
+	rng    *rand.Rand
 
-	e := Element{
-		Key:   x,
-		Error: s.alphas[xhash],
-		Count: s.alphas[xhash] + count,
-	}
-	s.k.elts[0] = e
+	// normalizer maps keys before they are counted, or is nil
+	normalizer func(string) string
 
-	// we're not longer monitoring minKey
-	delete(s.k.m, minElement.Key)
-	// but 'x' is as array position 0
-	s.k.m[x] = 0
+	// collate orders keys with equal counts, or is nil for byte order
+	collate func(a, b string) bool
 
-	heap.Fix(&s.k, 0)
-	return e
+	// evicted logs recent evictions, or is nil unless WithEvictionLog
+	evicted *evictionLog
+
+	// arena stores copies of admitted keys, or is nil unless WithKeyArena
+	arena  *keyArena
+	keyLen int // expected length of keys, or 0 if unknown
+
+	// listener is notified of inserts, or is nil unless WithListener
+	listener Listener
+
+	// batch is set within Batch, where rebuild records that the heap must be
+	// rebuilt when it returns
+	batch   bool
+	rebuild bool
+
+	// warm buffers the first inserts, or is nil unless WithWarmup
+	warm *warmup
+
+	// store holds the monitored elements instead of k, or is nil unless
+	// WithStore
+	store Store
+
+	// promoted holds the elements counted exactly, outside the heap, once
+	// their count reached promoteAt; nil unless WithExactAbove or decoded
+	promoted    map[string]Element
+	promoteAt   int
+	maxPromoted int
+
+	// sideEpochs holds the epoch of the last update of each element outside
+	// the heap, promoted or in a Store, as the heap stamps do for its
+	// elements; nil until one is updated in an epoch other than 0
+	sideEpochs map[string]uint64
+
+	// cdf is the cumulative distribution of counts over k.elts used by
+	// Sample, or nil if the monitored elements changed since it was built
+	cdf []int
+
+	// sorted caches the result of Keys WithKeysCache, or is nil if the
+	// monitored elements changed since it was built
+	cacheKeys bool
+	sorted    []Element
 }
 
-// Merge ...
-func (s *Stream) Merge(other *Stream) error {
-	if s.n != other.n {
-		return fmt.Errorf("expected stream of size n %d, got %d", s.n, other.n)
+// invalidate drops data derived from the monitored elements, after they
+// changed
+func (s *Stream) invalidate() {
+	s.cdf = nil
+	s.sorted = nil
+}
+
+// Option configures optional behaviour of a Stream
+type Option func(*Stream)
+
+// WithConservativeUpdate makes the alpha filter use conservative updates.
+//
+// Each key is hashed to two filter buckets and its filter count is the
+// minimum of the two.  Updates only raise a bucket as far as needed to hold
+// the new filter count, and evictions never lower a bucket, so the filter
+// count remains an upper bound for every key.  This deviates from the FSS
+// paper, which uses a single bucket per key: colliding tail keys inflate each
+// other less, so fewer are falsely admitted and monitored elements carry much
+// smaller errors, at the cost of a second bucket lookup per insert.  Estimates
+// for unmonitored keys may be looser, since buckets are never lowered.
+func WithConservativeUpdate() Option {
+	return func(s *Stream) {
+		s.conservative = true
 	}
+}
 
-	// merge the elements
-	eKeys := make(map[string]struct{})
-	eMap := make(map[string]Element)
-	for _, e := range s.k.elts {
-		eKeys[e.Key] = struct{}{}
+// WithCardinality enables estimating the number of distinct keys inserted
+// into the stream, reported by Cardinality.  It adds a 16KiB HyperLogLog
+// sketch that is updated on every Insert and encoded with the stream.
+func WithCardinality() Option {
+	return func(s *Stream) {
+		s.hll = newHLL()
 	}
-	for _, e := range other.k.elts {
-		eKeys[e.Key] = struct{}{}
+}
+
+// WithAlphaRatio sets the size of the alpha filter to ratio times n, instead
+// of the constant 6 suggested by the paper.  A larger filter reduces
+// collisions between unmonitored keys at the cost of memory.
+func WithAlphaRatio(ratio int) Option {
+	return func(s *Stream) {
+		s.filterRatio = ratio
 	}
+}
 
-	for k := range eKeys {
-		idx1, ok1 := s.k.m[k]
-		idx2, ok2 := other.k.m[k]
-		xhash := reduce(metro.Hash64Str(k, 0), len(s.alphas))
-		min1 := other.alphas[xhash]
-		min2 := other.alphas[xhash]
+// WithUint32Alphas backs the alpha filter with uint32 rather than int
+// counters, halving the memory of the filter, which is 6n counters and the
+// largest allocation of a Stream.  Filter counts saturate at math.MaxUint32,
+// so it should only be used when no key's count exceeds that.
+func WithUint32Alphas() Option {
+	return func(s *Stream) {
+		s.narrow = true
+	}
+}
 
-		switch {
-		case ok1 && ok2:
-			e1 := s.k.elts[idx1]
-			e2 := other.k.elts[idx2]
-			eMap[k] = Element{
-				Key:   k,
-				Count: e1.Count + e2.Count,
-				Error: e1.Error + e2.Error,
-			}
-		case ok1:
-			e1 := s.k.elts[idx1]
-			eMap[k] = Element{
-				Key:   k,
-				Count: e1.Count + min2,
-				Error: e1.Error + min2,
-			}
-		case ok2:
-			e2 := other.k.elts[idx2]
-			eMap[k] = Element{
-				Key:   k,
-				Count: e2.Count + min1,
-				Error: e2.Error + min1,
-			}
-		}
+// ratio returns the size of the alpha filter relative to n
+func (s *Stream) ratio() int {
+	if s.n > 0 && s.alphaLen() > 0 {
+		return s.alphaLen() / s.n
+	}
+	return alphaRatio
+}
 
+// WithRecencyEviction breaks ties between the lowest counts by evicting the
+// least recently updated element, rather than an arbitrary one.  This deviates
+// from the paper: a key that was just admitted with the minimum count is not
+// immediately evicted by the next new key, giving surging keys a chance to
+// accumulate counts.  Recency is not preserved by encoding.
+func WithRecencyEviction() Option {
+	return func(s *Stream) {
+		s.k.recency = true
 	}
+}
 
-	// sort the elements
-	elts := make([]Element, 0, len(eMap))
-	for _, v := range eMap {
-		elts = append(elts, v)
+// WithExactCounts keeps an exact count of every inserted key alongside the
+// estimates, reported by ExactCount, so tests and benchmarks can measure the
+// estimation error directly.  It stores every distinct key, defeating the
+// purpose of the Stream, and must not be used in production.  Exact counts
+// are not encoded.
+func WithExactCounts() Option {
+	return func(s *Stream) {
+		s.exact = make(map[string]int)
 	}
-	sort.Sort(elementsByCountDescending(elts))
+}
 
-	// trim elements
-	if len(elts) > s.n {
-		elts = elts[:s.n]
+// WithInterner stores monitored keys through in, so streams sharing in keep a
+// single copy of each key.  Keys are interned when they are admitted.
+func WithInterner(in *Interner) Option {
+	return func(s *Stream) {
+		s.interner = in
 	}
+}
 
-	// create heap
-	tk := keys{
-		m:    make(map[string]int),
-		elts: make([]Element, 0, s.n),
+// intern returns the key to store when admitting x, copied unless
+// WithoutKeyCopy
+func (s *Stream) intern(x string) string {
+	return s.internKey(x, !s.nocopy)
+}
+
+// internKey returns the key to store for x, through the interner if any,
+// copying it if clone is set and it is not already interned
+func (s *Stream) internKey(x string, clone bool) string {
+	if s.interner != nil {
+		return s.interner.intern(x, clone)
 	}
-	for _, e := range elts {
-		heap.Push(&tk, e)
+	if clone && s.arena != nil {
+		return s.arena.alloc(x)
 	}
-
-	// modify alphas
-	for i, v := range other.alphas {
-		s.alphas[i] += v
+	if clone {
+		return strings.Clone(x)
 	}
-
-	// replace k
-	s.k = tk
-	return nil
+	return x
 }
 
-// Keys returns the current estimates for the most frequent elements
-func (s *Stream) Keys() []Element {
-	elts := append([]Element(nil), s.k.elts...)
-	sort.Sort(elementsByCountDescending(elts))
-	if len(elts) > s.n {
-		elts = elts[:s.n]
+// WithoutKeyCopy stores admitted keys as passed to Insert instead of copying
+// them.  By default the stream copies each key when it is admitted, so that a
+// key that is a substring of a larger string, or a view into a reused or
+// unsafe buffer, does not keep that memory alive for as long as the key is
+// monitored.  Callers whose keys are already independent strings can skip
+// the copy and its allocation.
+func WithoutKeyCopy() Option {
+	return func(s *Stream) {
+		s.nocopy = true
 	}
-	return elts
 }
 
-// Estimate returns an estimate for the item x
-func (s *Stream) Estimate(x string) Element {
-	xhash := reduce(metro.Hash64Str(x, 0), len(s.alphas))
+// Rounding controls how Scale rounds scaled counts to integers
+type Rounding int
 
-	// are we tracking this element?
-	if idx, ok := s.k.m[x]; ok {
-		e := s.k.elts[idx]
-		return e
-	}
+const (
+	// RoundHalfUp rounds to the nearest integer, halves upwards
+	RoundHalfUp Rounding = iota
+	// RoundFloor rounds down, biasing counts low
+	RoundFloor
+	// RoundCeil rounds up, biasing counts high
+	RoundCeil
+)
 
-	count := s.alphas[xhash]
-	e := Element{
-		Key:   x,
-		Error: count,
-		Count: count,
+// WithRounding sets how Scale rounds counts, which defaults to RoundHalfUp.
+//
+// Rounding decides which keys survive scaling by small factors: as counts
+// shrink, many collapse to the same value, and eviction among equal counts
+// falls back to the heap's tie-break (the larger Error is evicted first).
+// RoundFloor collapses the most keys onto the minimum count, and can drop
+// small counts to zero; RoundCeil keeps every nonzero count at least 1.
+func WithRounding(mode Rounding) Option {
+	return func(s *Stream) {
+		s.rounding = mode
 	}
-	return e
 }
 
-// EncodeMsgp ...
-func (s *Stream) EncodeMsgp(w *msgp.Writer) error {
-	if err := w.WriteInt(s.n); err != nil {
-		return err
+func (s *Stream) round(v float64) int {
+	switch s.rounding {
+	case RoundFloor:
+		return int(math.Floor(v))
+	case RoundCeil:
+		return int(math.Ceil(v))
+	default:
+		return int(math.Floor(v + 0.5))
 	}
+}
 
-	if err := w.WriteArrayHeader(uint32(len(s.alphas))); err != nil {
-		return err
+// WithCollator orders elements with equal counts in Keys and its variants by
+// less instead of by byte order, e.g. for case-insensitive or locale-aware
+// leaderboards.  Keys that less considers equal are still ordered by byte
+// order, so the order stays deterministic.
+func WithCollator(less func(a, b string) bool) Option {
+	return func(s *Stream) {
+		s.collate = less
 	}
+}
 
-	for _, a := range s.alphas {
-		if err := w.WriteInt(a); err != nil {
-			return err
+// less reports whether a ranks before b: by descending count, then by the
+// collator
+func (s *Stream) less(a, b Element) bool {
+	if a.Count != b.Count {
+		return a.Count > b.Count
+	}
+	if s.collate != nil {
+		if s.collate(a.Key, b.Key) {
+			return true
+		}
+		if s.collate(b.Key, a.Key) {
+			return false
 		}
 	}
+	return a.Key < b.Key
+}
 
-	return s.k.EncodeMsgp(w)
+// sortElements sorts elts in the order returned by Keys
+func (s *Stream) sortElements(elts []Element) {
+	if s.collate == nil {
+		sort.Sort(elementsByCountDescending(elts))
+		return
+	}
+	sort.Slice(elts, func(i, j int) bool { return s.less(elts[i], elts[j]) })
 }
 
-// DecodeMsgp ...
-func (s *Stream) DecodeMsgp(r *msgp.Reader) error {
-	var (
-		err error
-		sz  uint32
-	)
+// WithAdmitProbability makes Insert admit a key that passed the filter check
+// only with probability p, drawing from rng; otherwise its count is added to
+// the alpha filter as for a rejected key.  This damps churn from keys near
+// the eviction threshold repeatedly replacing each other.  rng should be
+// seeded for reproducible results, and must not be shared with other
+// goroutines.
+//
+// The filter counts remain upper bounds, so estimates still never
+// underestimate, but a key that is turned away keeps accumulating in the
+// filter and is admitted later with a larger Error.  The lower p, the longer
+// genuinely frequent keys take to be monitored and the looser their bounds.
+// Without a filter there is nowhere to keep the count of a key turned away,
+// so WithoutFilter disables the draw and every key is admitted.
+func WithAdmitProbability(p float64, rng *rand.Rand) Option {
+	return func(s *Stream) {
+		s.admitP, s.rng = p, rng
+	}
+}
 
-	if s.n, err = r.ReadInt(); err != nil {
-		return err
+// admit reports whether a key that passed the filter check is admitted
+func (s *Stream) admit() bool {
+	return s.rng == nil || s.nofilter || s.rng.Float64() < s.admitP
+}
+
+// WithKeyNormalizer makes the stream count keys by their normalized form,
+// e.g. strings.ToLower to aggregate mixed-case hostnames.  normalize is
+// applied once to the key passed to every method that takes one, before it
+// is hashed or looked up, and monitored elements store the normalized key.
+// The default is the identity.
+func WithKeyNormalizer(normalize func(string) string) Option {
+	return func(s *Stream) {
+		s.normalizer = normalize
 	}
+}
 
-	if sz, err = r.ReadArrayHeader(); err != nil {
-		return err
+func (s *Stream) normalize(x string) string {
+	if s.normalizer == nil {
+		return x
 	}
+	return s.normalizer(x)
+}
 
-	s.alphas = make([]int, sz)
-	for i := range s.alphas {
-		if s.alphas[i], err = r.ReadInt(); err != nil {
-			return err
-		}
+// WithSortedStorage keeps the monitored elements sorted by count rather than
+// in a heap, so Keys reverses them in O(n) instead of sorting them in
+// O(n log n); only runs of equal counts are sorted by key.  In exchange,
+// every update that changes an element's position shifts the elements in
+// between: an insert finds the new position by binary search in O(log n),
+// but moves O(n) elements in the worst case, where the heap needs O(log n).
+// Pick it when Keys is called far more often than elements are updated.
+//
+// Estimates and evictions are the same as with the heap, except which of
+// several minimum elements with equal Count and Error is evicted, which the
+// heap leaves to its layout; WithRecencyEviction makes that choice the same
+// for both.
+func WithSortedStorage() Option {
+	return func(s *Stream) {
+		s.k.sorted = true
 	}
+}
 
-	return s.k.DecodeMsp(r)
+// WithRankTransform orders the elements in the eviction heap by
+// rank(Count) instead of Count, e.g. a logarithm bucketed to integers, while
+// storing and reporting the counts themselves.  rank must be nondecreasing
+// in the count.  The default is linear.
+//
+// Since rank is monotonic, it only changes which element is evicted among
+// elements of equal rank: these are evicted least recently updated first
+// WithRecencyEviction, and otherwise largest Error first, rather than lowest
+// Count first.  A strictly increasing rank, such as math.Log on its own,
+// changes nothing; a coarse one such as math.Floor(math.Log2(c)) lets keys
+// with a lower count but smaller Error survive keys up to twice as frequent.
+// Evicting an element that is not the minimum weakens the bounds of the
+// algorithm: the Count of a key admitted later still upper bounds its true
+// count, but a key may be counted less than the minimum Count and evicted
+// anyway, so the guarantee that every key more frequent than the minimum is
+// monitored no longer holds.  Keys still orders by Count, which rank
+// preserves.
+func WithRankTransform(rank func(count int) float64) Option {
+	return func(s *Stream) {
+		s.k.rank = rank
+	}
 }
 
-// Encode ...
-func (s *Stream) Encode(w io.Writer) error {
-	wrt := msgp.NewWriter(w)
-	if err := s.EncodeMsgp(wrt); err != nil {
-		return err
+// WithKeysCache caches the sorted elements returned by Keys until the stream
+// is next modified, so polling Keys between inserts only copies them.  Keys
+// then writes to the stream, so unlike other reads it must not run
+// concurrently with any other call, even under a shared read lock.
+// LockedStream does not use the cache.
+func WithKeysCache() Option {
+	return func(s *Stream) {
+		s.cacheKeys = true
 	}
-	return wrt.Flush()
 }
 
-// Decode ...
-func (s *Stream) Decode(r io.Reader) error {
+// WithHits counts, in the Hits of each element, the inserts of its key
+// regardless of their counts, telling keys heavy by volume from keys heavy
+// by frequency.  Eviction still orders by Count.
+func WithHits() Option {
+	return func(s *Stream) {
+		s.hits = true
+	}
+}
+
+// WithZeroCountQuery makes inserts with a count of 0 pure queries: they
+// return the estimate of Estimate and change nothing, neither the monitored
+// elements and filter nor the totals, Hits, observation times or distinct
+// count, and are classified as Queried without notifying a Listener.
+//
+// Without it an insert of 0 goes through the usual path.  On a full stream
+// it usually falls short of the minimum and leaves the filter as it was, so
+// it looks like a query, but it still counts as an insert and may admit the
+// key with a count of 0 into free space or when the minimum Count is 0.
+func WithZeroCountQuery() Option {
+	return func(s *Stream) {
+		s.query0 = true
+	}
+}
+
+// WithMaxCount clamps the Count of every monitored element at max during
+// Insert, so that a runaway key cannot dominate the stream and the ranking
+// stays responsive to the other keys under adversarial traffic.  The Error
+// of an element is clamped along with its Count.  Set, InsertElement and
+// the end of warm-up clamp the elements they update as well.
+//
+// Clamping biases estimates: counts of keys that reached max are
+// underestimated, and are no longer upper bounds of their true counts.
+// Elements clamped to the same Count are ordered as any other tie.
+func WithMaxCount(max int) Option {
+	return func(s *Stream) {
+		s.maxCount = max
+	}
+}
+
+// clamp limits the count and error of e to the maximum count, if any
+func (s *Stream) clamp(e *Element) {
+	if s.maxCount <= 0 {
+		return
+	}
+	if e.Count > s.maxCount {
+		e.Count = s.maxCount
+	}
+	if e.Error > e.Count {
+		e.Error = e.Count
+	}
+}
+
+// WithoutFilter disables the alpha filter, making the stream behave as the
+// classic Space-Saving algorithm: once full, every insert of an unmonitored
+// key evicts the minimum element and takes over its count as error.  No
+// filter is allocated, saving 6n counters.
+//
+// The filter is what distinguishes FSS from Space-Saving: without it, every
+// tail key is admitted and immediately becomes the new minimum, so monitored
+// elements churn much more and carry larger errors, and unmonitored keys are
+// all estimated at the minimum count.  It suits low-cardinality streams where
+// evictions are rare.
+func WithoutFilter() Option {
+	return func(s *Stream) {
+		s.nofilter = true
+	}
+}
+
+// WithEpochs records, for each monitored element, the epoch in which it was
+// last updated, so that KeysSince can report the elements active in recent
+// windows without clearing the stream.  The epoch starts at 0 and is advanced
+// by NewEpoch.  The current epoch and the element epochs are encoded with the
+// stream.
+func WithEpochs() Option {
+	return func(s *Stream) {
+		s.k.epochs = true
+	}
+}
+
+// Mode controls how Update treats negative counts
+type Mode int
+
+const (
+	// Additive streams only accept non-negative counts, as assumed by the
+	// algorithm.  Update and InsertChecked return ErrNegativeCount for
+	// negative counts.
+	Additive Mode = iota
+	// Signed streams accept negative counts in Update and InsertChecked,
+	// which decrement monitored elements and are otherwise ignored.
+	Signed
+)
+
+// ErrNegativeCount is returned by Update and InsertChecked for a negative
+// count in Additive mode
+var ErrNegativeCount = errors.New("topk: negative count in additive mode")
+
+// WithMode sets the Mode of the stream, which defaults to Additive
+func WithMode(m Mode) Option {
+	return func(s *Stream) {
+		s.mode = m
+	}
+}
+
+// EstimateN suggests an n for New with which the stream captures the true
+// top trueK keys of a stream whose counts follow a Zipfian distribution with
+// exponent skew.  It is an advisory calculator for sizing, not a guarantee.
+//
+// It uses the bound of Metwally, Agrawal and El Abbadi, "Efficient
+// Computation of Frequent and Top-k Elements in Data Streams" (2005): for a
+// noiseless Zipfian stream with skew > 1, Space-Saving reports the exact top
+// k with O((k/skew)^(1/skew) * k) counters, taken here with a constant of 1.
+// The filter only improves on Space-Saving, so the estimate is conservative.
+// For skew <= 1 the space needed grows with the number of distinct keys, and
+// the limit of the bound as skew approaches 1, trueK², is returned as a
+// starting point to validate against real traffic.  The result is never less
+// than trueK.
+func EstimateN(trueK int, skew float64) int {
+	if trueK <= 0 {
+		return 0
+	}
+	k := float64(trueK)
+	n := k * k
+	if skew > 1 {
+		n = math.Pow(k/skew, 1/skew) * k
+	}
+	if n >= math.MaxInt32 {
+		return math.MaxInt32
+	}
+	if n < k {
+		return trueK
+	}
+	return int(math.Ceil(n))
+}
+
+// New returns a Stream estimating the top n most frequent elements
+func New(n int, opts ...Option) *Stream {
+	s := &Stream{
+		n: n,
+		k: newKeys(n),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if !s.nofilter {
+		ratio := alphaRatio
+		if s.filterRatio > 0 {
+			ratio = s.filterRatio
+		}
+		if s.narrow {
+			s.alphas32 = make([]uint32, n*ratio)
+		} else {
+			s.alphas = make([]int, n*ratio)
+		}
+	}
+	// the layout is kept by the filter itself from now on
+	s.filterRatio, s.narrow = 0, false
+	if s.store != nil {
+		// the heap only holds elements while moved out of the store
+		s.k = s.k.empty(0)
+	}
+	if s.arena != nil && s.keyLen > 0 {
+		s.arena.presize(n * s.keyLen)
+	}
+	return s
+}
+
+// NewPercent returns a Stream estimating the top percent of expectedDistinct
+// keys, e.g. the top 1% of users, with n = ceil(expectedDistinct * percent /
+// 100).  A non-zero share always tracks at least one key.  It returns an
+// error wrapping ErrInvalidN for a negative expectedDistinct or a percent
+// outside of [0, 100].
+//
+// n is derived from the expected number of distinct keys only: how accurately
+// the stream captures the top keys still depends on the actual distribution
+// of counts, and a cardinality larger than expected makes n cover a smaller
+// share of the keys.
+func NewPercent(expectedDistinct int, percent float64, opts ...Option) (*Stream, error) {
+	if expectedDistinct < 0 {
+		return nil, fmt.Errorf("%w: %d expected distinct keys", ErrInvalidN, expectedDistinct)
+	}
+	if !(percent >= 0 && percent <= 100) {
+		return nil, fmt.Errorf("%w: percent %v", ErrInvalidN, percent)
+	}
+	n := int(math.Ceil(float64(expectedDistinct) * percent / 100))
+	return New(n, opts...), nil
+}
+
+// FromElements returns a Stream estimating the top n most frequent elements,
+// monitoring elts with their Count and Error preserved.  This restores a
+// snapshot taken with Keys, keeping its error bounds.  Repeated keys have
+// their counts and errors summed.
+//
+// If there are more than n distinct keys, the n largest are monitored and the
+// rest are recorded in the alpha filter as if they had been evicted.  The
+// filter is otherwise empty, since the snapshot holds no information about
+// unmonitored keys.
+func FromElements(n int, elts []Element, opts ...Option) *Stream {
+	s := New(n, opts...)
+
+	sum := make(map[string]Element, len(elts))
+	for _, e := range elts {
+		e.Key = s.normalize(e.Key)
+		if prev, ok := sum[e.Key]; ok {
+			e.Count += prev.Count
+			e.Error += prev.Error
+			e.Value += prev.Value
+			e.Hits += prev.Hits
+			e.addSeen(prev)
+		}
+		sum[e.Key] = e
+	}
+
+	all := make([]Element, 0, len(sum))
+	for _, e := range sum {
+		all = append(all, e)
+	}
+	sort.Sort(elementsByCountDescending(all))
+
+	for i, e := range all {
+		if i >= n {
+			s.raiseAlpha(metro.Hash64Str(e.Key, 0), e.Count)
+			continue
+		}
+		e.Key = s.intern(e.Key)
+		s.k.m[e.Key] = len(s.k.elts)
+		s.k.elts = append(s.k.elts, e)
+		s.k.stamps = append(s.k.stamps, stamp{})
+	}
+	s.k.init()
+	if s.store != nil {
+		s.storeHeap(s.store)
+	}
+
+	return s
+}
+
+// ResetN reinitializes the stream to estimate the top newN most frequent
+// elements, leaving it in the same state as New(newN).
+//
+// If newN times the stream's alpha ratio fits within the capacity of the
+// current alphas slice, its backing array is zeroed and reused instead of
+// allocating a new one, so shrinking (or keeping) n does not reallocate the
+// filter.
+func (s *Stream) ResetN(newN int) {
+	sz := newN * s.ratio()
+	switch {
+	case s.nofilter:
+	case s.alphas32 != nil && sz <= cap(s.alphas32):
+		s.alphas32 = s.alphas32[:sz]
+		for i := range s.alphas32 {
+			s.alphas32[i] = 0
+		}
+	case s.alphas32 == nil && sz <= cap(s.alphas):
+		s.alphas = s.alphas[:sz]
+		for i := range s.alphas {
+			s.alphas[i] = 0
+		}
+	default:
+		s.makeAlphas(sz)
+	}
+
+	s.n = newN
+	s.invalidate()
+	s.total, s.inserts = 0, 0
+	if s.exact != nil {
+		s.exact = make(map[string]int)
+	}
+	if s.hll != nil {
+		s.hll.reset()
+	}
+	if s.evicted != nil {
+		s.evicted.drain()
+	}
+	if s.arena != nil {
+		s.arena.reset()
+	}
+	if s.promoted != nil {
+		s.promoted = make(map[string]Element)
+	}
+	s.sideEpochs = nil
+	if s.warm != nil {
+		s.warm.restart()
+	}
+	if s.store != nil {
+		s.clearStore()
+		newN = 0
+	}
+	s.k = s.k.empty(newN)
+}
+
+// ResetReuse clears the stream as Clear does, but reuses all its buffers: the
+// alpha filter and monitored elements are zeroed in place and the key index
+// is emptied with the clear builtin, keeping its buckets, so a stream reused
+// across fixed windows of the same size does not allocate to reset, unless it
+// has an eviction log to drain.  It requires Go 1.21.
+func (s *Stream) ResetReuse() {
+	clear(s.alphas)
+	clear(s.alphas32)
+	s.invalidate()
+	s.total, s.inserts = 0, 0
+	clear(s.exact)
+	if s.hll != nil {
+		s.hll.reset()
+	}
+	if s.evicted != nil {
+		s.evicted.drain()
+	}
+	if s.arena != nil {
+		s.arena.reset()
+	}
+	clear(s.promoted)
+	if s.store != nil {
+		s.clearStore()
+	}
+	clear(s.sideEpochs)
+	if s.warm != nil {
+		s.warm.restart()
+	}
+
+	// don't keep the dropped keys alive in the spare capacity
+	clear(s.k.elts)
+	s.k.elts, s.k.stamps = s.k.elts[:0], s.k.stamps[:0]
+	clear(s.k.m)
+}
+
+// Scale multiplies the counts, errors and values of all monitored elements
+// and the alpha filter by factor, rounding as configured WithRounding.  A
+// factor below 1 decays the stream so that recent inserts outweigh older ones.
+// factor must not be negative.
+func (s *Stream) Scale(factor float64) {
+	if s.store != nil {
+		s.viaHeap(func() { s.Scale(factor) })
+		return
+	}
+	for i := range s.k.elts {
+		s.k.elts[i].Count = s.round(float64(s.k.elts[i].Count) * factor)
+		s.k.elts[i].Error = s.round(float64(s.k.elts[i].Error) * factor)
+		s.k.elts[i].Value = int64(s.round(float64(s.k.elts[i].Value) * factor))
+	}
+	for k, e := range s.promoted {
+		e.Count = s.round(float64(e.Count) * factor)
+		e.Error = s.round(float64(e.Error) * factor)
+		e.Value = int64(s.round(float64(e.Value) * factor))
+		s.promoted[k] = e
+	}
+	for i := 0; i < s.alphaLen(); i++ {
+		s.setAlphaAt(i, s.round(float64(s.alphaAt(i))*factor))
+	}
+
+	s.heapify()
+	s.invalidate()
+}
+
+// DecayElapsed scales the stream by factor once per tick, as ticks calls to
+// Scale(factor) would, but in a single pass with the combined multiplier
+// factor^ticks, to catch up after the stream was idle.  It does nothing if
+// ticks is not positive.
+//
+// Counts are rounded once, from the exact product, whereas successive calls
+// to Scale round after every tick.  The results can therefore differ by the
+// rounding error accumulated over the ticks: with RoundFloor repeated scaling
+// decays faster, with RoundCeil slower, and with RoundHalfUp the difference
+// is small in either direction.
+func (s *Stream) DecayElapsed(factor float64, ticks int) {
+	if ticks <= 0 {
+		return
+	}
+	s.Scale(math.Pow(factor, float64(ticks)))
+}
+
+// SetAlphaFloor raises every alpha filter count below v to v, e.g. after a
+// merge, so that all unmonitored keys start from the same filter count.  It
+// does nothing for a stream created WithoutFilter.
+//
+// Insert admits an unmonitored key when its filter count plus the inserted
+// count reaches the minimum monitored Count, and the admitted element takes
+// the filter count as its Error.  Raising the floor therefore lowers the
+// count a new key needs to be admitted, to the minimum Count minus v, and
+// gives every newly admitted key an Error of at least v.  A floor at or
+// above the minimum Count admits every new key on its first insert.
+func (s *Stream) SetAlphaFloor(v int) {
+	for i := 0; i < s.alphaLen(); i++ {
+		if s.alphaAt(i) < v {
+			s.setAlphaAt(i, v)
+		}
+	}
+}
+
+// Clear removes all elements from the stream, leaving it as it was when
+// created.  The alpha filter is reused, but the monitored elements and key
+// index are reallocated, so no previously stored key remains reachable from
+// the stream and the key strings can be garbage collected.
+func (s *Stream) Clear() {
+	s.ResetN(s.n)
+}
+
+// Drain returns the current estimates for the most frequent elements, as
+// Keys does, and clears the stream.  Since Stream is not safe for concurrent
+// use, callers share it under their own lock; holding it across a single
+// Drain ensures no insert lands between the read and the clear, so every
+// insert is either reflected in the result or in the cleared stream.
+func (s *Stream) Drain() []Element {
+	elts := s.Keys()
+	s.Clear()
+	return elts
+}
+
+// TrimToTop keeps only the m elements with the highest counts and stops
+// monitoring the rest, which are recorded in the alpha filter as if they had
+// been evicted.  The heap is rebuilt once from the kept elements.
+func (s *Stream) TrimToTop(m int) {
+	if s.store != nil {
+		s.viaHeap(func() { s.TrimToTop(m) })
+		return
+	}
+	if m < 0 {
+		m = 0
+	}
+	if m >= len(s.k.elts) {
+		return
+	}
+
+	sort.Sort(keysByCountDescending{&s.k})
+	for i, e := range s.k.elts[m:] {
+		s.raiseAlpha(metro.Hash64Str(e.Key, 0), e.Count)
+		delete(s.k.m, e.Key)
+
+		// don't keep the dropped keys alive in the spare capacity
+		s.k.elts[m+i] = Element{}
+	}
+
+	s.k.elts, s.k.stamps = s.k.elts[:m], s.k.stamps[:m]
+	for i, e := range s.k.elts {
+		s.k.m[e.Key] = i
+	}
+	s.heapify()
+	s.invalidate()
+}
+
+// Batch calls f with s, deferring the heap rebuilds of bulk mutations until
+// f returns, so that several of them in a row share a single O(n) rebuild.
+// Within f the monitored elements are not ordered as a heap, so only Scale,
+// DecayElapsed, TrimToTop, SetAlphaFloor, Estimate and Stats may be called:
+// inserts, merges and Keys rely on the heap and must happen outside of f.
+// Nested batches rebuild once, when the outermost returns.
+func (s *Stream) Batch(f func(*Stream)) {
+	if s.batch {
+		f(s)
+		return
+	}
+
+	s.batch = true
+	defer func() {
+		s.batch = false
+		if s.rebuild {
+			s.rebuild = false
+			s.k.init()
+		}
+	}()
+	f(s)
+}
+
+// heapify rebuilds the heap after a bulk mutation, or defers it to the end of
+// the current Batch
+func (s *Stream) heapify() {
+	if s.batch {
+		s.rebuild = true
+		return
+	}
+	s.k.init()
+}
+
+// Compact releases memory held by the monitored elements after the stream
+// shrank, e.g. with TrimToTop, by reallocating them and the key index at
+// their current size.  Later inserts grow them again as needed.
+func (s *Stream) Compact() {
+	elts := make([]Element, len(s.k.elts))
+	copy(elts, s.k.elts)
+	stamps := make([]stamp, len(s.k.stamps))
+	copy(stamps, s.k.stamps)
+
+	m := make(map[string]int, len(elts))
+	for i, e := range elts {
+		m[e.Key] = i
+	}
+
+	s.k.elts, s.k.stamps, s.k.m = elts, stamps, m
+}
+
+func reduce(x uint64, n int) uint32 {
+	return uint32(uint64(uint32(x)) * uint64(n) >> 32)
+}
+
+// makeAlphas allocates a zeroed alpha filter of size sz
+func (s *Stream) makeAlphas(sz int) {
+	if s.alphas32 != nil {
+		s.alphas32 = make([]uint32, sz)
+	} else {
+		s.alphas = make([]int, sz)
+	}
+}
+
+func (s *Stream) alphaLen() int {
+	if s.alphas32 != nil {
+		return len(s.alphas32)
+	}
+	return len(s.alphas)
+}
+
+func (s *Stream) alphaAt(i int) int {
+	if s.alphas32 != nil {
+		return int(s.alphas32[i])
+	}
+	return s.alphas[i]
+}
+
+func (s *Stream) setAlphaAt(i, v int) {
+	if s.alphas32 == nil {
+		s.alphas[i] = v
+		return
+	}
+
+	switch {
+	case v < 0:
+		s.alphas32[i] = 0
+	case uint64(v) > math.MaxUint32:
+		s.alphas32[i] = math.MaxUint32
+	default:
+		s.alphas32[i] = uint32(v)
+	}
+}
+
+// alpha returns the filter count for the key hash h
+//
+// Without a filter it is the minimum count once the stream is full, which
+// is the Space-Saving bound for every unmonitored key.
+func (s *Stream) alpha(h uint64) int {
+	if s.nofilter {
+		if s.size() < s.n {
+			return 0
+		}
+		e, _ := s.min()
+		return e.Count
+	}
+	if s.alphaLen() == 0 {
+		// a zero Stream has no filter
+		return 0
+	}
+
+	a := s.alphaAt(int(reduce(h, s.alphaLen())))
+	if s.conservative {
+		if b := s.alphaAt(int(reduce(h>>32, s.alphaLen()))); b < a {
+			a = b
+		}
+	}
+	return a
+}
+
+// setAlpha sets the filter count for the key hash h to v.  With conservative
+// updates each bucket is only ever raised to v, never lowered.
+func (s *Stream) setAlpha(h uint64, v int) {
+	if s.nofilter || s.alphaLen() == 0 {
+		return
+	}
+
+	i := int(reduce(h, s.alphaLen()))
+	if !s.conservative {
+		s.setAlphaAt(i, v)
+		return
+	}
+	if s.alphaAt(i) < v {
+		s.setAlphaAt(i, v)
+	}
+	if j := int(reduce(h>>32, s.alphaLen())); s.alphaAt(j) < v {
+		s.setAlphaAt(j, v)
+	}
+}
+
+// raiseAlpha raises the filter count for the key hash h to at least v.  It is
+// used when evicting many elements at once, so that colliding evictions do
+// not overwrite each other's counts.
+func (s *Stream) raiseAlpha(h uint64, v int) {
+	if s.alpha(h) < v {
+		s.setAlpha(h, v)
+	}
+}
+
+// Insert adds an element to the stream to be tracked
+// It returns an estimation for the just inserted element
+// count must not be negative; use Update to have this enforced
+func (s *Stream) Insert(x string, count int) Element {
+	e, _, _ := s.insert(s.normalize(x), count, 0)
+	return e
+}
+
+// InsertValue adds an element to the stream as Insert does, adding value to
+// the Value of x if it is monitored.  Values only accumulate while a key is
+// monitored: a key admitted by evicting another starts from value, so like
+// Count-Error its Value is a lower bound on the key's true total.  Eviction
+// still orders by Count.
+func (s *Stream) InsertValue(x string, count int, value int64) Element {
+	e, _, _ := s.insert(s.normalize(x), count, value)
+	return e
+}
+
+// InsertAt adds an element to the stream as Insert does, recording ts, a
+// caller-supplied timestamp, as the LastSeen of x if it is monitored after
+// the insert.  When x is admitted its FirstSeen is set to ts as well: a key
+// that is evicted and later admitted again starts over, so FirstSeen is the
+// start of its current stay in the stream.  Elements keep the timestamps of
+// their first and last InsertAt; ordering is unaffected.
+func (s *Stream) InsertAt(x string, count int, ts int64) Element {
+	x = s.normalize(x)
+	e, _, a := s.insert(x, count, 0)
+	if a == Filtered || a == Queried {
+		return e
+	}
+
+	e.LastSeen = ts
+	if a != Tracked || e.FirstSeen == 0 {
+		e.FirstSeen = ts
+	}
+	if _, ok := s.promoted[x]; ok {
+		s.promoted[x] = e
+	} else if s.store != nil {
+		s.store.Set(e)
+	} else {
+		s.k.elts[s.k.m[x]] = e
+	}
+	return e
+}
+
+// InsertReplace adds an element to the stream as Insert does, also returning
+// the element it evicted, if any.  didEvict is only true when x replaced the
+// minimum element, which is returned with its last Count and Error.
+func (s *Stream) InsertReplace(x string, count int) (current, evicted Element, didEvict bool) {
+	current, evicted, a := s.insert(s.normalize(x), count, 0)
+	return current, evicted, a == Replaced
+}
+
+// WithSafeMode makes InsertChecked validate that the monitored elements and
+// their index agree before each insert, so that a stream corrupted e.g. by a
+// buggy decoder returns an error instead of panicking.  Without it
+// InsertChecked behaves as Insert, keeping the fast path fast.  Merge also
+// validates both streams before merging in safe mode, returning an error
+// wrapping ErrInconsistent without modifying the stream if a key is
+// monitored twice or the index of the stream merged into is corrupt.
+func WithSafeMode() Option {
+	return func(s *Stream) {
+		s.safe = true
+	}
+}
+
+// InsertChecked adds an element to the stream as Insert does.  A negative
+// count is handled as Update does, returning ErrNegativeCount in Additive
+// mode without modifying the stream.  In safe mode
+// it returns an error wrapping ErrInconsistent, without modifying the
+// stream, if the parts of the heap the insert would touch are corrupt, and
+// converts a panic during the insert into an error; the stream should then
+// be discarded.
+func (s *Stream) InsertChecked(x string, count int) (e Element, err error) {
+	x = s.normalize(x)
+	if count < 0 {
+		return s.update(x, count)
+	}
+	if !s.safe || s.store != nil {
+		e, _, _ = s.insert(x, count, 0)
+		return e, nil
+	}
+	if err := s.check(x); err != nil {
+		return Element{}, err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: insert of %q panicked: %v", ErrInconsistent, x, r)
+		}
+	}()
+	e, _, _ = s.insert(x, count, 0)
+	return e, nil
+}
+
+// check validates the parts of the heap an insert of x would touch: the
+// element of x if it is monitored, or otherwise the size of the heap and
+// the index of the minimum element it may evict
+func (s *Stream) check(x string) error {
+	if len(s.k.m) != len(s.k.elts) {
+		return fmt.Errorf("%w: index has %d keys for %d elements", ErrInconsistent, len(s.k.m), len(s.k.elts))
+	}
+	if len(s.k.elts) > s.n {
+		return fmt.Errorf("%w: %d elements exceed n %d", ErrInvalidN, len(s.k.elts), s.n)
+	}
+	if idx, ok := s.k.m[x]; ok {
+		if idx < 0 || idx >= len(s.k.elts) || s.k.elts[idx].Key != x {
+			return fmt.Errorf("%w: key %q indexed at %d", ErrInconsistent, x, idx)
+		}
+		return nil
+	}
+	if len(s.k.elts) > 0 && len(s.k.elts) == s.n {
+		if idx, ok := s.k.m[s.k.elts[0].Key]; !ok || idx != 0 {
+			return fmt.Errorf("%w: minimum element %q not indexed", ErrInconsistent, s.k.elts[0].Key)
+		}
+	}
+	return nil
+}
+
+// checkIndex validates that each monitored key is held by exactly one
+// element: indexed at its own position in the heap, and not also promoted.
+// Keys may share backing memory with keys of other streams or with each
+// other, e.g. after Merge or with an Interner, which is safe since strings
+// are immutable; what must hold is that no key is monitored twice.
+func (s *Stream) checkIndex() error {
+	if err := s.k.checkIndex(); err != nil {
+		return err
+	}
+	for k := range s.promoted {
+		if _, ok := s.k.m[k]; ok {
+			return fmt.Errorf("%w: key %q both promoted and in the heap", ErrInconsistent, k)
+		}
+		if s.store != nil {
+			if _, ok := s.store.Get(k); ok {
+				return fmt.Errorf("%w: key %q both promoted and in the store", ErrInconsistent, k)
+			}
+		}
+	}
+	return nil
+}
+
+// checkDistinct validates that no key is monitored twice without using the
+// key index, which a stream decoded for merging lacks
+func (s *Stream) checkDistinct() error {
+	seen := make(map[string]struct{}, len(s.k.elts))
+	for _, e := range s.k.elts {
+		if _, ok := seen[e.Key]; ok {
+			return fmt.Errorf("%w: duplicate key %q in elements", ErrInconsistent, e.Key)
+		}
+		if _, ok := s.promoted[e.Key]; ok {
+			return fmt.Errorf("%w: key %q both promoted and in the heap", ErrInconsistent, e.Key)
+		}
+		seen[e.Key] = struct{}{}
+	}
+	return nil
+}
+
+// Validate checks the invariants of the algorithm, e.g. after decoding a
+// stream from an untrusted source, and returns an error wrapping
+// ErrInconsistent or ErrInvalidN describing the first violation: every
+// monitored element must have 0 <= Error <= Count, no filter count may be
+// negative, the elements must form a valid heap of at most n elements, and
+// each monitored key must be indexed at its own element.  In Signed mode,
+// where negative updates may take a Count below its Error, only Error >= 0
+// is checked.  Elements held in a Store or promoted WithExactAbove are
+// checked as well, except for the heap order, which only applies to the
+// built-in heap.
+func (s *Stream) Validate() error {
+	if s.size() > s.n {
+		return fmt.Errorf("%w: %d elements exceed n %d", ErrInvalidN, s.size(), s.n)
+	}
+	if err := s.checkIndex(); err != nil {
+		return err
+	}
+	for _, e := range s.elements() {
+		if e.Error < 0 {
+			return fmt.Errorf("%w: key %q has negative error %d", ErrInconsistent, e.Key, e.Error)
+		}
+		if s.mode != Signed && e.Error > e.Count {
+			return fmt.Errorf("%w: key %q has error %d above its count %d", ErrInconsistent, e.Key, e.Error, e.Count)
+		}
+	}
+	if s.store == nil {
+		if err := s.WalkHeap(nil); err != nil {
+			return fmt.Errorf("%w: %w", ErrInconsistent, err)
+		}
+	}
+	for i := 0; i < s.alphaLen(); i++ {
+		if a := s.alphaAt(i); a < 0 {
+			return fmt.Errorf("%w: negative filter count %d at %d", ErrInconsistent, a, i)
+		}
+	}
+	return nil
+}
+
+// Admission classifies how an insert was handled
+type Admission int
+
+const (
+	// Tracked means the key was already monitored
+	Tracked Admission = iota
+	// Admitted means the key was admitted into free space
+	Admitted
+	// Filtered means the key was not admitted and counted in the filter
+	Filtered
+	// Replaced means the key was admitted by evicting the minimum element
+	Replaced
+	// Queried means nothing changed, as the count was 0 in a stream created
+	// WithZeroCountQuery
+	Queried
+)
+
+// InsertClassified adds an element to the stream as Insert does, also
+// returning how the insert was handled, e.g. to measure the admission rate
+// and the effectiveness of the filter
+func (s *Stream) InsertClassified(x string, count int) (Element, Admission) {
+	e, _, a := s.insert(s.normalize(x), count, 0)
+	return e, a
+}
+
+func (s *Stream) insert(x string, count int, value int64) (Element, Element, Admission) {
+	e, evicted, a := s.record(x, count, value)
+	if s.listener != nil {
+		s.notify(e, evicted, a, count)
+	}
+	return e, evicted, a
+}
+
+// record counts x in the stream without notifying the listener
+func (s *Stream) record(x string, count int, value int64) (Element, Element, Admission) {
+	if count == 0 && s.query0 {
+		return s.estimate(x), Element{}, Queried
+	}
+
+	xhash := metro.Hash64Str(x, 0)
+	s.invalidate()
+	s.total += int64(count)
+	s.inserts++
+	if s.exact != nil {
+		s.exact[x] += count
+	}
+	if s.hll != nil {
+		s.hll.insert(xhash)
+	}
+
+	var hit int64
+	if s.hits {
+		hit = 1
+	}
+
+	if s.warm != nil && s.warm.left > 0 {
+		return s.buffer(x, count, value, hit)
+	}
+	return s.count(x, xhash, count, value, hit)
+}
+
+// count updates the monitored elements and the filter for an insert of x,
+// after record did the bookkeeping common to all inserts
+func (s *Stream) count(x string, xhash uint64, count int, value, hit int64) (Element, Element, Admission) {
+	// is this element counted exactly?
+	if e, ok := s.promoted[x]; ok {
+		e.Count += count
+		e.Value += value
+		e.Hits += hit
+		s.clamp(&e)
+		s.touchSide(x)
+		s.promoted[x] = e
+		return e, Element{}, Tracked
+	}
+	if s.store != nil {
+		return s.recordStore(x, xhash, count, value, hit)
+	}
+
+	// are we tracking this element?
+	if idx, ok := s.k.m[x]; ok {
+		s.k.elts[idx].Count += count
+		s.k.elts[idx].Value += value
+		s.k.elts[idx].Hits += hit
+		s.clamp(&s.k.elts[idx])
+		s.k.touch(idx)
+		e := s.k.elts[idx]
+		s.k.fix(idx)
+		s.promote(x)
+		return e, Element{}, Tracked
+	}
+
+	// can we track more elements?
+	if len(s.k.elts) < s.n {
+		// there is free space
+		e := Element{Key: s.intern(x), Count: count, Value: value, Hits: hit}
+		s.clamp(&e)
+		s.k.push(e, s.k.now())
+		s.promote(e.Key)
+		return e, Element{}, Admitted
+	}
+
+	// nothing is monitored if n is 0, e.g. in a zero Stream
+	if alpha := s.alpha(xhash); len(s.k.elts) == 0 || alpha+count < s.k.elts[0].Count || !s.admit() {
+		e := Element{
+			Key:   x,
+			Error: alpha,
+			Count: alpha + count,
+		}
+		s.setAlpha(xhash, alpha+count)
+		return e, Element{}, Filtered
+	}
+
+	// replace the current minimum element
+	minElement := s.k.elts[0]
+
+	s.setAlpha(metro.Hash64Str(minElement.Key, 0), minElement.Count)
+
+	alpha := s.alpha(xhash)
+	e := Element{
+		Key:   s.intern(x),
+		Error: alpha,
+		Count: alpha + count,
+		Value: value,
+		Hits:  hit,
+	}
+	s.clamp(&e)
+	s.k.elts[0], s.k.stamps[0] = e, s.k.now()
+
+	// we're not longer monitoring minKey
+	delete(s.k.m, minElement.Key)
+	// but 'x' is as array position 0
+	s.k.m[e.Key] = 0
+
+	s.k.fix(0)
+	if s.evicted != nil {
+		s.evicted.add(minElement)
+	}
+	s.promote(e.Key)
+	return e, minElement, Replaced
+}
+
+// Track admits x with a count of 0 if there is free space, e.g. to seed keys
+// known to be important before traffic arrives, and reports whether x is
+// monitored.  On a full stream it is a no-op for unmonitored keys and returns
+// false.  Tracked keys are evicted like any other once the stream is full,
+// starting with those that received no inserts.
+func (s *Stream) Track(x string) bool {
+	x = s.normalize(x)
+	if _, ok := s.monitored(x); ok {
+		return true
+	}
+	if s.store != nil {
+		if s.store.Len() >= s.n {
+			return false
+		}
+		x = s.intern(x)
+		s.store.Set(Element{Key: x})
+		s.touchSide(x)
+		s.invalidate()
+		return true
+	}
+	if len(s.k.elts) >= s.n {
+		return false
+	}
+	s.k.push(Element{Key: s.intern(x)}, s.k.now())
+	s.invalidate()
+	return true
+}
+
+// InsertMap inserts each key of counts with its count, as Insert does, e.g.
+// to fold the counts of a window into a long-lived stream.
+//
+// The order of inserts decides which near-threshold keys are admitted or
+// evicted, and map iteration order is random, so the entries are inserted in
+// a fixed order: by descending count, then by key.  This makes the result
+// deterministic, and inserting larger counts first keeps small counts from
+// evicting elements only to be evicted themselves.
+func (s *Stream) InsertMap(counts map[string]int) {
+	elts := make([]Element, 0, len(counts))
+	for k, c := range counts {
+		elts = append(elts, Element{Key: k, Count: c})
+	}
+	sort.Sort(elementsByCountDescending(elts))
+
+	for _, e := range elts {
+		s.Insert(e.Key, e.Count)
+	}
+}
+
+// InsertElement adds e to the stream preserving its recorded Count and Error,
+// for loading elements incrementally from a snapshot.  If e.Key is already
+// monitored, e's Count and Error are added to it.  On a full stream e goes
+// through the same admission check as Insert; if admitted it replaces the
+// minimum element with its Count and Error unchanged, and otherwise its Count
+// is added to the alpha filter.
+func (s *Stream) InsertElement(e Element) Element {
+	e.Key = s.normalize(e.Key)
+	xhash := metro.Hash64Str(e.Key, 0)
+	s.invalidate()
+	s.total += int64(e.Count)
+	s.inserts++
+	if s.exact != nil {
+		s.exact[e.Key] += e.Count
+	}
+	if s.hll != nil {
+		s.hll.insert(xhash)
+	}
+
+	e = Element{Key: e.Key, Count: e.Count, Error: e.Error, Value: e.Value, Hits: e.Hits, FirstSeen: e.FirstSeen, LastSeen: e.LastSeen}
+
+	if _, ok := s.promoted[e.Key]; ok {
+		s.addPromoted(e, s.k.now().epoch)
+		p := s.promoted[e.Key]
+		s.clamp(&p)
+		s.promoted[e.Key] = p
+		return p
+	}
+	if s.store != nil {
+		return s.insertStore(e, xhash)
+	}
+
+	if idx, ok := s.k.m[e.Key]; ok {
+		s.k.elts[idx].Count += e.Count
+		s.k.elts[idx].Error += e.Error
+		s.k.elts[idx].Value += e.Value
+		s.k.elts[idx].Hits += e.Hits
+		s.k.elts[idx].addSeen(e)
+		s.clamp(&s.k.elts[idx])
+		s.k.touch(idx)
+		e = s.k.elts[idx]
+		s.k.fix(idx)
+		return e
+	}
+
+	if len(s.k.elts) < s.n {
+		e.Key = s.intern(e.Key)
+		s.clamp(&e)
+		s.k.push(e, s.k.now())
+		return e
+	}
+
+	if alpha := s.alpha(xhash); len(s.k.elts) == 0 || alpha+e.Count < s.k.elts[0].Count {
+		s.setAlpha(xhash, alpha+e.Count)
+		return Element{Key: e.Key, Count: alpha + e.Count, Error: alpha}
+	}
+
+	e.Key = s.intern(e.Key)
+	s.clamp(&e)
+
+	minElement := s.k.elts[0]
+	s.setAlpha(metro.Hash64Str(minElement.Key, 0), minElement.Count)
+	s.k.elts[0], s.k.stamps[0] = e, s.k.now()
+	delete(s.k.m, minElement.Key)
+	s.k.m[e.Key] = 0
+	s.k.fix(0)
+	if s.evicted != nil {
+		s.evicted.add(minElement)
+	}
+	return e
+}
+
+// Set sets the count of x to exactly count, for sources that report totals
+// rather than deltas.  If x is monitored its Count is replaced and, since the
+// caller supplied the true total, its Error is reset to 0.  During warm-up
+// the buffered count of x is replaced likewise.  Otherwise x is inserted
+// with count as if by Insert.  A Listener is notified of the change of a
+// monitored Count through OnUpdate.
+func (s *Stream) Set(x string, count int) Element {
+	x = s.normalize(x)
+	e, ok := s.promoted[x]
+	var stored bool
+	if !ok && s.store != nil {
+		e, stored = s.store.Get(x)
+	}
+	idx, monitored := s.k.m[x]
+	b, buffered := s.buffered(x)
+	if !ok && !stored && !monitored && !buffered {
+		e, _, _ := s.insert(x, count, 0)
+		return e
+	}
+
+	s.invalidate()
+	if s.exact != nil {
+		s.exact[x] = count
+	}
+	var delta int
+	switch {
+	case ok:
+		delta = -e.Count
+		e.Count, e.Error = count, 0
+		s.clamp(&e)
+		delta += e.Count
+		s.touchSide(x)
+		s.promoted[x] = e
+	case stored:
+		delta = -e.Count
+		e.Count, e.Error = count, 0
+		s.clamp(&e)
+		delta += e.Count
+		s.touchSide(x)
+		s.store.Set(e)
+	case monitored:
+		delta = -s.k.elts[idx].Count
+		s.k.elts[idx].Count = count
+		s.k.elts[idx].Error = 0
+		s.clamp(&s.k.elts[idx])
+		delta += s.k.elts[idx].Count
+		s.k.touch(idx)
+		e = s.k.elts[idx]
+		s.k.fix(idx)
+	default:
+		delta = count - b.Count
+		b.Count = count
+		s.warm.buf[b.Key] = b
+		s.total += int64(delta)
+		return Element{Key: x, Count: count}
+	}
+	s.total += int64(delta)
+	if s.listener != nil {
+		s.listener.OnUpdate(e, delta)
+	}
+	return e
+}
+
+// Update adds count to the element x according to the Mode of the stream.
+// Non-negative counts are inserted as with Insert.  Negative counts return
+// ErrNegativeCount in Additive mode; in Signed mode they decrement x if it is
+// monitored or buffered during warm-up, and otherwise leave the stream
+// unchanged, since the filter count is shared by many keys and cannot be
+// decremented for just one.
+func (s *Stream) Update(x string, count int) (Element, error) {
+	if count >= 0 {
+		return s.Insert(x, count), nil
+	}
+	return s.update(s.normalize(x), count)
+}
+
+// update decrements x by the negative count according to the Mode
+func (s *Stream) update(x string, count int) (Element, error) {
+	if s.mode != Signed {
+		return Element{}, ErrNegativeCount
+	}
+
+	p, promoted := s.promoted[x]
+	var stored bool
+	if !promoted && s.store != nil {
+		p, stored = s.store.Get(x)
+	}
+	idx, ok := s.k.m[x]
+	b, buffered := s.buffered(x)
+	if !ok && !promoted && !stored && !buffered {
+		return s.estimate(x), nil
+	}
+
+	s.invalidate()
+	s.total += int64(count)
+	s.inserts++
+	if s.exact != nil {
+		s.exact[x] += count
+	}
+	e := p
+	switch {
+	case promoted:
+		e.Count += count
+		s.touchSide(x)
+		s.promoted[x] = e
+	case stored:
+		e.Count += count
+		s.touchSide(x)
+		s.store.Set(e)
+	case ok:
+		s.k.elts[idx].Count += count
+		s.k.touch(idx)
+		e = s.k.elts[idx]
+		s.k.fix(idx)
+	default:
+		b.Count += count
+		s.warm.buf[b.Key] = b
+		return Element{Key: x, Count: b.Count}, nil
+	}
+	if s.listener != nil {
+		s.listener.OnUpdate(e, count)
+	}
+	return e, nil
+}
+
+// Merge merges other into s, which must not have a smaller n than other.
+//
+// Merging into a larger stream, e.g. aggregating shards into a stream that
+// can hold all their keys, keeps every key while s has free space.  Keys
+// only monitored by other are admitted with their Count and Error plus the
+// filter count of s for the key, which is 0 until s or a stream merged into
+// it evicted, so merging streams that never evicted sums their counts
+// exactly.  Only once s saturates are elements dropped.
+//
+// If the alpha filters differ in size, the alphas of other are re-bucketed
+// into the filter of s: each bucket of other is added to every bucket of s
+// that hashes of its keys can fall into.  This keeps the filter counts upper
+// bounds, but merging into a larger filter spreads each count over several
+// buckets, so estimates for unmonitored keys are looser than for streams
+// with equal filters.
+//
+// Warm-up of both streams is ended first, as EndWarmup does, so other is
+// modified if it is still warming up.
+func (s *Stream) Merge(other *Stream) error {
+	_, err := s.MergeWithStats(other)
+	return err
+}
+
+// MergeStats describes how lossy a merge was
+type MergeStats struct {
+	// AddedError is the error added to the kept elements.  An element
+	// monitored by only one stream has a filter count for its key added to
+	// both its Count and Error, since it may have been counted in the
+	// filter of the other; elements monitored by both streams add no error
+	// beyond the sum of their own.
+	AddedError int64
+	// Dropped is the number of elements that ranked below the n kept and
+	// were discarded because the merged stream was full
+	Dropped int
+}
+
+// MergeWithStats merges other into s as Merge does, also reporting the
+// error the merge added
+func (s *Stream) MergeWithStats(other *Stream) (MergeStats, error) {
+	return s.merge(other, false)
+}
+
+// MergeExact merges other into s as Merge does, taking the counts of other as
+// exact, e.g. for a fresh window that has not filled up yet.  No filter count
+// of other is added to the elements: keys only monitored by other keep their
+// Count and Error, which is 0 for a window that never evicted, and keys only
+// monitored by s are assumed not to have been counted by other.  The alpha
+// filters are still merged, so estimates of unmonitored keys remain upper
+// bounds.
+//
+// This differs from Merge when other is full, in particular WithoutFilter,
+// where Merge treats the minimum Count of other as the count any key it does
+// not monitor may have had.  If other did drop counts, the bounds of the
+// merged elements no longer hold.
+func (s *Stream) MergeExact(other *Stream) error {
+	_, err := s.merge(other, true)
+	return err
+}
+
+// merge merges other into s, adding the filter counts of other to the
+// elements it does not monitor unless exact is set
+func (s *Stream) merge(other *Stream, exact bool) (MergeStats, error) {
+	if s.store != nil || other.store != nil {
+		return s.mergeStores(other, exact)
+	}
+
+	var st MergeStats
+	if other.n > s.n {
+		return st, fmt.Errorf("expected stream of size n at most %d, got %d", s.n, other.n)
+	}
+	if s.safe {
+		if err := s.checkIndex(); err != nil {
+			return st, err
+		}
+		if err := other.checkDistinct(); err != nil {
+			return st, err
+		}
+	}
+	s.EndWarmup()
+	other.EndWarmup()
+
+	// merge the promoted elements, which absorb the heap elements of their
+	// keys below
+	for k, e := range other.promoted {
+		e.Key = s.internKey(e.Key, false)
+		s.addPromoted(e, other.sideEpochs[k])
+	}
+
+	// merge the elements, looking keys up in s only so that other needs no
+	// index; the epoch of a key is the later of its epochs in either stream
+	eMap := make(map[string]Element, len(s.k.elts)+len(other.k.elts))
+	epochs := make(map[string]uint64)
+	added := make(map[string]int)
+	for i, e2 := range other.k.elts {
+		k := e2.Key
+		epoch2 := other.k.stamps[i].epoch
+		if _, ok := s.promoted[k]; ok {
+			e2.Key = s.internKey(k, false)
+			s.addPromoted(e2, epoch2)
+			continue
+		}
+		idx1, ok1 := s.k.m[k]
+		if !ok1 {
+			// k may have been counted in our filter, which stays empty
+			// until an eviction
+			var min1 int
+			if !exact {
+				min1 = s.alpha(metro.Hash64Str(k, 0))
+			}
+			added[k] = min1
+			eMap[k] = Element{
+				Key:   k,
+				Count: e2.Count + min1,
+				Error: e2.Error + min1,
+				Value: e2.Value,
+				Hits:  e2.Hits,
+
+				FirstSeen: e2.FirstSeen,
+				LastSeen:  e2.LastSeen,
+			}
+			epochs[k] = epoch2
+			continue
+		}
+		e1 := s.k.elts[idx1]
+		e := Element{
+			Key:   e1.Key,
+			Count: e1.Count + e2.Count,
+			Error: e1.Error + e2.Error,
+			Value: e1.Value + e2.Value,
+			Hits:  e1.Hits + e2.Hits,
+
+			FirstSeen: e1.FirstSeen,
+			LastSeen:  e1.LastSeen,
+		}
+		e.addSeen(e2)
+		eMap[k] = e
+		epochs[k] = max(s.k.stamps[idx1].epoch, epoch2)
+	}
+	for i, e1 := range s.k.elts {
+		k := e1.Key
+		if _, ok := s.promoted[k]; ok {
+			s.addPromoted(e1, s.k.stamps[i].epoch)
+			continue
+		}
+		if _, ok := eMap[k]; ok {
+			continue
+		}
+		var min2 int
+		if !exact {
+			min2 = other.alpha(metro.Hash64Str(k, 0))
+		}
+		added[k] = min2
+		eMap[k] = Element{
+			Key:   k,
+			Count: e1.Count + min2,
+			Error: e1.Error + min2,
+			Value: e1.Value,
+			Hits:  e1.Hits,
+
+			FirstSeen: e1.FirstSeen,
+			LastSeen:  e1.LastSeen,
+		}
+		epochs[k] = s.k.stamps[i].epoch
+	}
+
+	// sort the elements
+	elts := make([]Element, 0, len(eMap))
+	for _, v := range eMap {
+		elts = append(elts, v)
+	}
+	sort.Sort(elementsByCountDescending(elts))
+
+	// trim elements
+	if len(elts) > s.n {
+		st.Dropped = len(elts) - s.n
+		elts = elts[:s.n]
+	}
+	for _, e := range elts {
+		st.AddedError += int64(added[e.Key])
+	}
+
+	// create heap
+	tk := s.k.empty(s.n)
+	for _, e := range elts {
+		// the keys are already owned by one of the streams
+		e.Key = s.internKey(e.Key, false)
+		tk.push(e, stamp{epoch: epochs[e.Key]})
+	}
+
+	// modify alphas
+	s.mergeAlphas(other)
+
+	if s.hll != nil && other.hll != nil {
+		s.hll.merge(other.hll)
+	}
+
+	s.total += other.total
+	s.inserts += other.inserts
+
+	if s.exact != nil && other.exact != nil {
+		for k, v := range other.exact {
+			s.exact[k] += v
+		}
+	}
+
+	// replace k
+	s.k = tk
+	s.invalidate()
+	return st, nil
+}
+
+// mergeStores merges other into s as merge does, with the elements of their
+// stores in heaps
+func (s *Stream) mergeStores(other *Stream, exact bool) (st MergeStats, err error) {
+	s.EndWarmup()
+	other.EndWarmup()
+	if other.store != nil {
+		other = other.heapCopy()
+	}
+	if s.store == nil {
+		return s.merge(other, exact)
+	}
+	s.viaHeap(func() { st, err = s.merge(other, exact) })
+	return st, err
+}
+
+// MergeDecode merges a stream encoded with Encode into s as Merge does,
+// without decoding it into a full Stream first: the encoded key index is
+// skipped and the encoded elements are folded into s directly, so memory
+// stays bounded by the size of one snapshot when aggregating many of them.
+// On error s is left unmodified.
+func (s *Stream) MergeDecode(r io.Reader) error {
+	src, err := s.decodeSource(msgp.NewReader(r))
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %w", ErrTruncated, err)
+	}
+	if err != nil {
+		return err
+	}
+	return s.Merge(src)
+}
+
+// decodeSource decodes an encoded stream to merge into s, leaving its key
+// index empty as merging only looks keys up in s
+func (s *Stream) decodeSource(r *msgp.Reader) (*Stream, error) {
+	src := &Stream{}
+	var err error
+	if src.n, err = r.ReadInt(); err != nil {
+		return nil, err
+	}
+	if src.n > s.n {
+		return nil, fmt.Errorf("expected stream of size n at most %d, got %d", s.n, src.n)
+	}
+
+	sz, err := r.ReadArrayHeader()
+	if err != nil {
+		return nil, err
+	}
+	src.alphas = make([]int, sz)
+	for i := range src.alphas {
+		if src.alphas[i], err = r.ReadInt(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = r.Skip(); err != nil {
+		return nil, err
+	}
+	if err = src.k.decodeElements(r, false); err != nil {
+		return nil, err
+	}
+	if len(src.k.elts) > src.n {
+		return nil, fmt.Errorf("%w: %d elements exceed n %d", ErrInvalidN, len(src.k.elts), src.n)
+	}
+	return src, src.decodeExtensions(r)
+}
+
+// mergeAlphas adds the alpha filter of other into that of s, re-bucketing
+// them if the filters differ in size.  A stream without a filter keeps none.
+func (s *Stream) mergeAlphas(other *Stream) {
+	if s.nofilter || s.alphaLen() == 0 {
+		return
+	}
+	if other.alphaLen() == s.alphaLen() {
+		for i := 0; i < s.alphaLen(); i++ {
+			s.setAlphaAt(i, s.alphaAt(i)+other.alphaAt(i))
+		}
+		return
+	}
+
+	src := uint64(other.alphaLen())
+	for i := 0; i < other.alphaLen(); i++ {
+		v := other.alphaAt(i)
+		if v == 0 {
+			continue
+		}
+
+		// bucket i holds the 32-bit hashes h with reduce(h, src) == i, so
+		// lo <= h <= hi; since reduce is monotonic they land in a
+		// contiguous range of our buckets
+		lo := (uint64(i)<<32 + src - 1) / src
+		hi := (uint64(i+1)<<32+src-1)/src - 1
+		for j := int(reduce(lo, s.alphaLen())); j <= int(reduce(hi, s.alphaLen())); j++ {
+			s.setAlphaAt(j, s.alphaAt(j)+v)
+		}
+	}
+}
+
+// PeekMin returns the monitored element that the next admission would evict,
+// without modifying the stream.  It returns false if nothing is monitored.
+// On a full stream, Insert admits an unmonitored key x with count c when its
+// alpha filter count plus c is at least the returned element's Count.
+func (s *Stream) PeekMin() (Element, bool) {
+	return s.min()
+}
+
+// AlphaHistogram returns the number of alpha filter counters in each of
+// buckets logarithmic buckets, to show whether the filtered tail consists of
+// many small counts or a few large ones.  Bucket 0 counts the counters that
+// are 0, bucket i the counters in [2^(i-1), 2^i), and the last bucket also
+// every larger counter.  It returns nil if buckets is not positive, and all
+// zeros without a filter.
+func (s *Stream) AlphaHistogram(buckets int) []int {
+	if buckets <= 0 {
+		return nil
+	}
+	hist := make([]int, buckets)
+	for i := 0; i < s.alphaLen(); i++ {
+		b := bits.Len(uint(s.alphaAt(i)))
+		if b >= buckets {
+			b = buckets - 1
+		}
+		hist[b]++
+	}
+	return hist
+}
+
+// InclusionThreshold returns a count above which a key is certain to be
+// monitored: once the inserted counts of a key exceed it, the key is in Keys.
+// It is 0 while the stream is not full, as every inserted key is admitted.
+//
+// An unmonitored key was counted at most the filter count of its bucket, so
+// any key counted more than the largest filter count is monitored; adding
+// the minimum monitored Count, which a key must reach to be admitted on its
+// own, keeps the threshold conservative.  It assumes counts are only added by
+// Insert: Update with negative counts, Decay, Scale, WithMaxCount and
+// WithAdmitProbability all void the guarantee.  The threshold never decreases
+// under inserts, so it describes how insensitive the stream has become.
+func (s *Stream) InclusionThreshold() int {
+	if s.size() == 0 || s.size() < s.n {
+		return 0
+	}
+	e, _ := s.min()
+	min := e.Count
+	if s.k.rank != nil {
+		// the root is the lowest rank, not necessarily the lowest Count
+		for _, e := range s.k.elts {
+			if e.Count < min {
+				min = e.Count
+			}
+		}
+	}
+	if s.nofilter {
+		// Space-Saving bounds unmonitored counts by the minimum
+		return 2 * min
+	}
+	var maxAlpha int
+	for i := 0; i < s.alphaLen(); i++ {
+		if a := s.alphaAt(i); a > maxAlpha {
+			maxAlpha = a
+		}
+	}
+	return maxAlpha + min
+}
+
+// N returns the number of elements the stream estimates the top of, as passed
+// to New or restored by Decode
+func (s *Stream) N() int {
+	return s.n
+}
+
+// IsFull reports whether the stream monitors n elements.  Until it does,
+// every insert is counted exactly and all estimates have zero error.
+func (s *Stream) IsFull() bool {
+	return s.size() >= s.n
+}
+
+// Fingerprint returns a hash of n and the monitored elements, independent of
+// their order in the heap, so streams with the same n and elements have the
+// same fingerprint.  The alpha filter is not included.
+func (s *Stream) Fingerprint() uint64 {
+	elts := append([]Element(nil), s.elements()...)
+	sort.Sort(elementsByKey(elts))
+
+	buf := binary.AppendUvarint(nil, uint64(s.n))
+	for _, e := range elts {
+		buf = binary.AppendUvarint(buf, uint64(len(e.Key)))
+		buf = append(buf, e.Key...)
+		buf = binary.AppendVarint(buf, int64(e.Count))
+		buf = binary.AppendVarint(buf, int64(e.Error))
+	}
+	return metro.Hash64(buf, 0)
+}
+
+// Stats summarizes the state of a Stream
+type Stats struct {
+	N        int   // maximum number of monitored elements
+	Tracked  int   // number of monitored elements
+	Total    int64 // sum of all inserted counts
+	Inserts  int64 // number of inserts
+	MinCount int   // smallest Count of the monitored elements
+	MaxCount int   // largest Count of the monitored elements
+	MaxError int   // largest Error of the monitored elements
+}
+
+// Stats returns a summary of the stream computed in a single pass
+func (s *Stream) Stats() Stats {
+	return statsOf(s.n, s.total, s.inserts, s.elements())
+}
+
+func statsOf(n int, total, inserts int64, elts []Element) Stats {
+	st := Stats{
+		N:       n,
+		Tracked: len(elts),
+		Total:   total,
+		Inserts: inserts,
+	}
+	for i, e := range elts {
+		if i == 0 || e.Count < st.MinCount {
+			st.MinCount = e.Count
+		}
+		if i == 0 || e.Count > st.MaxCount {
+			st.MaxCount = e.Count
+		}
+		if i == 0 || e.Error > st.MaxError {
+			st.MaxError = e.Error
+		}
+	}
+	return st
+}
+
+// CurrentSum returns the sum of the current Counts of the monitored elements.
+// Unlike the lifetime Total reported by Stats, the sum of all inserted
+// counts, it reflects the present state: it shrinks with Scale and
+// DecayElapsed, and includes the error merged into counts by Merge.  Divide
+// by CurrentSum rather than Total to compute the relative frequencies of
+// keys after decay.  Counts in the alpha filter are not included, since its
+// buckets are shared upper bounds rather than counts of distinct keys.
+func (s *Stream) CurrentSum() int64 {
+	var sum int64
+	for _, e := range s.elements() {
+		sum += int64(e.Count)
+	}
+	return sum
+}
+
+// Coverage returns the share of the lifetime Total held by the monitored
+// elements, CurrentSum divided by Total, or 0 if nothing was inserted.  Low
+// coverage means most traffic is in the tail outside the top n, and that n
+// may be too small.  Since Counts include their Error, coverage is an upper
+// bound, and it is capped at 1.  Scaling shrinks the counts but not Total,
+// so coverage is only meaningful for streams that were not decayed.
+func (s *Stream) Coverage() float64 {
+	if s.total <= 0 {
+		return 0
+	}
+	return math.Min(float64(s.CurrentSum())/float64(s.total), 1)
+}
+
+// ExactCount returns the exact count of x, and false if the stream was not
+// created WithExactCounts
+func (s *Stream) ExactCount(x string) (int, bool) {
+	if s.exact == nil {
+		return 0, false
+	}
+	return s.exact[s.normalize(x)], true
+}
+
+// Cardinality returns an estimate of the number of distinct keys inserted
+// into the stream, or 0 if the stream was not created WithCardinality
+func (s *Stream) Cardinality() uint64 {
+	if s.hll == nil {
+		return 0
+	}
+	return s.hll.estimate()
+}
+
+// Keys returns the current estimates for the most frequent elements.  Each
+// call returns a new slice that the caller may modify.
+func (s *Stream) Keys() []Element {
+	if !s.cacheKeys {
+		return s.sortedKeys()
+	}
+	if s.sorted == nil {
+		s.sorted = s.sortedKeys()
+	}
+	return append([]Element(nil), s.sorted...)
+}
+
+// RankedMap returns the m most frequent elements keyed by their 1-based rank,
+// in the order of Keys, including its order among equal counts.  If m exceeds
+// the number of monitored elements, all of them are returned.
+func (s *Stream) RankedMap(m int) map[int]Element {
+	if m < 0 {
+		m = 0
+	}
+	keys := s.Keys()
+	if m < len(keys) {
+		keys = keys[:m]
+	}
+	ranked := make(map[int]Element, len(keys))
+	for i, e := range keys {
+		ranked[i+1] = e
+	}
+	return ranked
+}
+
+// KeysInto writes the most frequent elements into dst, in the order of Keys,
+// and returns how many it wrote: len(dst), or the number of monitored
+// elements if there are fewer, in which case the rest of dst is left
+// untouched.  dst is used as scratch space to select the top elements, so
+// KeysInto does not allocate, except to collect the elements of a Store or
+// promoted elements.
+func (s *Stream) KeysInto(dst []Element) int {
+	if s.sorted != nil {
+		return copy(dst, s.sorted)
+	}
+	if len(dst) == 0 {
+		return 0
+	}
+
+	// keep the best len(dst) elements in a heap rooted at the worst of them
+	w := 0
+	for _, e := range s.elements() {
+		switch {
+		case w < len(dst):
+			dst[w] = e
+			w++
+			if w == len(dst) {
+				for i := w/2 - 1; i >= 0; i-- {
+					s.siftWorst(dst, i)
+				}
+			}
+		case s.less(e, dst[0]):
+			dst[0] = e
+			s.siftWorst(dst, 0)
+		}
+	}
+
+	slices.SortFunc(dst[:w], func(a, b Element) int {
+		switch {
+		case s.less(a, b):
+			return -1
+		case s.less(b, a):
+			return 1
+		}
+		return 0
+	})
+	return w
+}
+
+// siftWorst moves h[i] down the heap h, which keeps the element ordered last
+// by Keys at its root
+func (s *Stream) siftWorst(h []Element, i int) {
+	for {
+		worst := i
+		for _, c := range []int{2*i + 1, 2*i + 2} {
+			if c < len(h) && s.less(h[worst], h[c]) {
+				worst = c
+			}
+		}
+		if worst == i {
+			return
+		}
+		h[i], h[worst] = h[worst], h[i]
+		i = worst
+	}
+}
+
+// KeysAndTotal returns Keys along with the sum of all inserted counts, as
+// reported in Stats().Total, computed from the same state, e.g. to compute
+// the share of each key.  A Stream is not used concurrently, so calling Keys
+// and Stats in turn is just as consistent; LockedStream.KeysAndTotal reads
+// both under one lock.
+func (s *Stream) KeysAndTotal() ([]Element, int64) {
+	return s.Keys(), s.total
+}
+
+// sortedKeys returns the monitored elements sorted as Keys does, without
+// using the cache of WithKeysCache
+func (s *Stream) sortedKeys() []Element {
+	// elements sorted by rank need not be sorted by Count
+	if s.k.sorted && s.k.rank == nil && len(s.promoted) == 0 && s.store == nil {
+		return s.reversedKeys()
+	}
+
+	elts := append([]Element(nil), s.elements()...)
+	s.sortElements(elts)
+	if limit := s.n + len(s.promoted); len(elts) > limit {
+		elts = elts[:limit]
+	}
+	return elts
+}
+
+// reversedKeys returns the elements of a stream created WithSortedStorage in
+// the order of Keys, reversing them and only sorting runs of equal counts,
+// whose ties the storage order breaks differently
+func (s *Stream) reversedKeys() []Element {
+	n := len(s.k.elts)
+	if n == 0 {
+		return nil
+	}
+
+	elts := make([]Element, n)
+	for i, e := range s.k.elts {
+		elts[n-1-i] = e
+	}
+	for i := 0; i < n; {
+		j := i + 1
+		for j < n && elts[j].Count == elts[i].Count {
+			j++
+		}
+		if j-i > 1 {
+			s.sortElements(elts[i:j])
+		}
+		i = j
+	}
+	return elts
+}
+
+// GuaranteedElement is an Element returned by KeysWithGuarantee, along with
+// whether it is provably among the true top k
+type GuaranteedElement struct {
+	Element
+	Guaranteed bool
+}
+
+// KeysWithGuarantee returns the current estimates for the k most frequent
+// elements, as Keys does, reporting for each whether it is guaranteed to be
+// in the true top k.
+//
+// An element is guaranteed when its lower bound Count-Error is strictly
+// greater than the Count of the (k+1)-th ranked element, which bounds the
+// true count of every key outside the returned ones; ties are not
+// guaranteed.  This holds for the last returned element as for any other.
+// When k covers all monitored elements there is no (k+1)-th element, and the
+// bound is instead the largest count an unmonitored key could have: the
+// largest alpha filter count, or without a filter the minimum Count of a
+// full stream.
+func (s *Stream) KeysWithGuarantee(k int) []GuaranteedElement {
+	elts := s.Keys()
+	bound := s.unmonitoredBound()
+	if k < len(elts) {
+		if c := elts[k].Count; c > bound {
+			bound = c
+		}
+		elts = elts[:k]
+	}
+
+	res := make([]GuaranteedElement, len(elts))
+	for i, e := range elts {
+		res[i] = GuaranteedElement{Element: e, Guaranteed: e.Count-e.Error > bound}
+	}
+	return res
+}
+
+// Stability counts the top elements of a stream that are guaranteed to be in
+// the true top and those at risk of being displaced
+type Stability struct {
+	Guaranteed int
+	AtRisk     int
+}
+
+// StabilityReport counts how many of the current top m elements are
+// guaranteed to be in the true top m and how many are at risk, e.g. to alert
+// on leaderboard changes only when they are certain.  It uses the threshold
+// of KeysWithGuarantee: an element is guaranteed when Count-Error exceeds
+// both the Count of the (m+1)-th ranked element and the largest count an
+// unmonitored key could have, and at risk otherwise.  Guaranteed plus AtRisk
+// is less than m when fewer than m elements are monitored.
+func (s *Stream) StabilityReport(m int) Stability {
+	var st Stability
+	for _, e := range s.KeysWithGuarantee(m) {
+		if e.Guaranteed {
+			st.Guaranteed++
+		} else {
+			st.AtRisk++
+		}
+	}
+	return st
+}
+
+// Similarity returns the Jaccard index of the keys of the top m elements of
+// a and b, as returned by Keys: the number of keys in both sets divided by
+// the number of keys in either, from 0 for disjoint sets to 1 for equal ones,
+// e.g. to check whether two shards see the same hot keys.  A stream monitoring
+// fewer than m elements contributes all of them, and two empty sets are
+// equal.  The index is set-based and ignores counts, so a key hot in a and
+// barely in the top m of b counts as shared; a weighted variant could take
+// counts into account.
+func Similarity(a, b *Stream, m int) float64 {
+	if m < 0 {
+		m = 0
+	}
+	top := func(s *Stream) []Element {
+		elts := s.Keys()
+		if m < len(elts) {
+			elts = elts[:m]
+		}
+		return elts
+	}
+	ka, kb := top(a), top(b)
+
+	set := make(map[string]struct{}, len(ka))
+	for _, e := range ka {
+		set[e.Key] = struct{}{}
+	}
+	var shared int
+	for _, e := range kb {
+		if _, ok := set[e.Key]; ok {
+			shared++
+		}
+	}
+	union := len(ka) + len(kb) - shared
+	if union == 0 {
+		return 1
+	}
+	return float64(shared) / float64(union)
+}
+
+// unmonitoredBound returns an upper bound on the true count of any key that
+// is not monitored
+func (s *Stream) unmonitoredBound() int {
+	if s.nofilter {
+		return s.alpha(0)
+	}
+	var max int
+	for i := 0; i < s.alphaLen(); i++ {
+		if a := s.alphaAt(i); a > max {
+			max = a
+		}
+	}
+	return max
+}
+
+// KeysByName returns the current estimates for the monitored elements sorted
+// by key in byte order, independent of their counts, e.g. for dumps that are
+// diffed across runs
+func (s *Stream) KeysByName() []Element {
+	elts := append([]Element(nil), s.elements()...)
+	sort.Sort(elementsByKey(elts))
+	return elts
+}
+
+// KeysMatching returns the current estimates for the most frequent elements
+// whose keys satisfy pred.  Elements are filtered before sorting.
+func (s *Stream) KeysMatching(pred func(key string) bool) []Element {
+	var elts []Element
+	for _, e := range s.elements() {
+		if pred(e.Key) {
+			elts = append(elts, e)
+		}
+	}
+	s.sortElements(elts)
+	return elts
+}
+
+// KeysWithin returns the current estimates for the most frequent elements
+// whose keys are in allowed, e.g. the keys of one tenant.  Only monitored
+// keys are returned, so allowed keys that are not monitored are missing
+// rather than estimated from the filter.  Elements are filtered before
+// sorting, and when allowed is smaller than the stream its keys are looked up
+// instead of scanning the monitored elements.
+func (s *Stream) KeysWithin(allowed map[string]struct{}) []Element {
+	var elts []Element
+	if len(allowed) < len(s.k.elts)+len(s.promoted) || s.normalizer != nil || s.store != nil {
+		// keys normalizing to the same key must be returned once
+		var seen map[string]bool
+		if s.normalizer != nil {
+			seen = make(map[string]bool)
+		}
+		for k := range allowed {
+			k = s.normalize(k)
+			if seen != nil {
+				if seen[k] {
+					continue
+				}
+				seen[k] = true
+			}
+			if e, ok := s.monitored(k); ok {
+				elts = append(elts, e)
+			}
+		}
+	} else {
+		for _, e := range s.elements() {
+			if _, ok := allowed[e.Key]; ok {
+				elts = append(elts, e)
+			}
+		}
+	}
+	s.sortElements(elts)
+	return elts
+}
+
+// PrefixSummary returns how many monitored keys start with prefix and the sum
+// of their estimated counts, e.g. to drill down into hierarchical keys such
+// as a/b/c.  It only covers the currently monitored keys: keys under prefix
+// that were evicted or filtered are neither counted nor summed.  The prefix
+// is not normalized.
+func (s *Stream) PrefixSummary(prefix string) (keys int, total int) {
+	for _, e := range s.elements() {
+		if strings.HasPrefix(e.Key, prefix) {
+			keys++
+			total += e.Count
+		}
+	}
+	return keys, total
+}
+
+// monitored returns the element monitored for x, if any
+func (s *Stream) monitored(x string) (Element, bool) {
+	if e, ok := s.promoted[x]; ok {
+		return e, true
+	}
+	if s.store != nil {
+		return s.store.Get(x)
+	}
+	if idx, ok := s.k.m[x]; ok {
+		return s.k.elts[idx], true
+	}
+	return Element{}, false
+}
+
+// NewEpoch starts a new epoch and returns its id.  Elements updated from now
+// on are stamped with it.
+func (s *Stream) NewEpoch() uint64 {
+	s.k.epoch++
+	return s.k.epoch
+}
+
+// KeysSince returns the current estimates for the most frequent elements that
+// were updated in epoch or later.  Elements carried over from earlier epochs
+// without being updated are excluded.  Without WithEpochs all elements are
+// in epoch 0.
+func (s *Stream) KeysSince(epoch uint64) []Element {
+	var elts []Element
+	for i, e := range s.k.elts {
+		if s.k.stamps[i].epoch >= epoch {
+			elts = append(elts, e)
+		}
+	}
+	for k, e := range s.promoted {
+		if s.sideEpochs[k] >= epoch {
+			elts = append(elts, e)
+		}
+	}
+	if s.store != nil {
+		s.store.Each(func(e Element) bool {
+			if s.sideEpochs[e.Key] >= epoch {
+				elts = append(elts, e)
+			}
+			return true
+		})
+	}
+	s.sortElements(elts)
+	return elts
+}
+
+// ForEachAbove calls fn, in no particular order, for each monitored element
+// whose Count is greater than threshold.  fn receives a copy of the element.
+func (s *Stream) ForEachAbove(threshold int, fn func(Element)) {
+	for _, e := range s.elements() {
+		if e.Count > threshold {
+			fn(e)
+		}
+	}
+}
+
+// topIndex returns the monitored elements along with the indexes of the top
+// m of them in the order of Keys, sorting only the indexes.  A negative m
+// returns none.
+func (s *Stream) topIndex(m int) ([]Element, []int) {
+	elts := s.elements()
+	idx := make([]int, len(elts))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(a, b int) bool { return s.less(elts[idx[a]], elts[idx[b]]) })
+
+	if m < 0 {
+		m = 0
+	}
+	if m < len(idx) {
+		idx = idx[:m]
+	}
+	return elts, idx
+}
+
+// WriteKeysJSON writes the top m elements to w as a JSON array, in the same
+// order as Keys.  Only an index of the monitored elements is sorted and each
+// element is encoded as it is written, so the elements are never copied.
+func (s *Stream) WriteKeysJSON(w io.Writer, m int) error {
+	elts, idx := s.topIndex(m)
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	for i, j := range idx {
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if err := enc.Encode(elts[j]); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]")
+	return err
+}
+
+// Estimate returns an estimate for the item x
+func (s *Stream) Estimate(x string) Element {
+	return s.estimate(s.normalize(x))
+}
+
+func (s *Stream) estimate(x string) Element {
+	if e, ok := s.promoted[x]; ok {
+		return e
+	}
+	if e, ok := s.buffered(x); ok {
+		return e
+	}
+	if s.store != nil {
+		if e, ok := s.store.Get(x); ok {
+			return e
+		}
+		count := s.alpha(metro.Hash64Str(x, 0))
+		return Element{Key: x, Error: count, Count: count}
+	}
+
+	// are we tracking this element?
+	if idx, ok := s.k.m[x]; ok {
+		e := s.k.elts[idx]
+		return e
+	}
+
+	count := s.alpha(metro.Hash64Str(x, 0))
+	e := Element{
+		Key:   x,
+		Error: count,
+		Count: count,
+	}
+	return e
+}
+
+// EstimateTouch returns an estimate for x as Estimate does, and marks x as
+// accessed for WithRecencyEviction: among elements with the same minimum
+// count, x is then evicted after those neither updated nor touched since.
+// Estimate itself is a pure read, so keys that are only queried, e.g. by a
+// dashboard, are not kept monitored.  Touching does not move x into the
+// current epoch, which only updates do.
+func (s *Stream) EstimateTouch(x string) Element {
+	x = s.normalize(x)
+	idx, ok := s.k.m[x]
+	if !ok || !s.k.recency {
+		return s.estimate(x)
+	}
+
+	s.invalidate()
+	s.k.seq++
+	s.k.stamps[idx].seq = s.k.seq
+	e := s.k.elts[idx]
+	s.k.fix(idx)
+	return e
+}
+
+// WalkHeap calls fn for each monitored element in heap (array) order, with
+// its index and the index of its parent in the heap (-1 for the root).  fn
+// may be nil.  It returns an error listing every element that orders before
+// its parent, which would mean the heap property is violated, or ErrStore
+// for a stream created WithStore, which has no heap.
+func (s *Stream) WalkHeap(fn func(idx, parent int, e Element)) error {
+	if s.store != nil {
+		return fmt.Errorf("%w: no heap to walk", ErrStore)
+	}
+	var violations []string
+	for i, e := range s.k.elts {
+		parent := -1
+		if i > 0 {
+			parent = (i - 1) / 2
+			if s.k.Less(i, parent) {
+				violations = append(violations, fmt.Sprintf("%d (%q) orders before its parent %d (%q)", i, e.Key, parent, s.k.elts[parent].Key))
+			}
+		}
+		if fn != nil {
+			fn(i, parent, e)
+		}
+	}
+
+	if len(violations) > 0 {
+		return fmt.Errorf("heap violations: %s", strings.Join(violations, "; "))
+	}
+	return nil
+}
+
+// EstimateBytes returns an estimate for the item key.  Looking up a monitored
+// key does not allocate, unless the stream has a key normalizer or a Store;
+// unmonitored keys return a copy of key.
+func (s *Stream) EstimateBytes(key []byte) Element {
+	if s.normalizer != nil {
+		return s.Estimate(string(key))
+	}
+
+	// the compiler avoids allocating for string conversions in map lookups
+	if e, ok := s.promoted[string(key)]; ok {
+		return e
+	}
+	if s.warm != nil {
+		if e, ok := s.warm.buf[string(key)]; ok {
+			return e
+		}
+	}
+	if s.store != nil {
+		return s.estimate(string(key))
+	}
+	if idx, ok := s.k.m[string(key)]; ok {
+		return s.k.elts[idx]
+	}
+
+	count := s.alpha(metro.Hash64(key, 0))
+	return Element{
+		Key:   string(key),
+		Error: count,
+		Count: count,
+	}
+}
+
+// EstimateDebug returns the estimate for x along with whether x is monitored
+// and the alpha filter count x would be estimated from if it were not.  It
+// does not modify the stream.
+func (s *Stream) EstimateDebug(x string) (e Element, monitored bool, alpha int) {
+	x = s.normalize(x)
+	alpha = s.alpha(metro.Hash64Str(x, 0))
+	if e, ok := s.monitored(x); ok {
+		return e, true, alpha
+	}
+	if e, ok := s.buffered(x); ok {
+		return e, false, alpha
+	}
+	return Element{Key: x, Count: alpha, Error: alpha}, false, alpha
+}
+
+// EstimateRange returns the interval [low, high] the true count of x lies in.
+// For monitored elements this is [Count-Error, Count]; for unmonitored
+// elements it is [0, alpha] where alpha is the filter count for x.
+func (s *Stream) EstimateRange(x string) (low, high int) {
+	e := s.Estimate(x)
+	return e.Count - e.Error, e.Count
+}
+
+// QueryResult describes a key as returned by Query
+type QueryResult struct {
+	// Key is the key queried, after normalization
+	Key string
+	// Count is an upper bound on the true count of Key: the estimated Count
+	// of a monitored key, or the alpha filter count of an unmonitored one
+	Count int
+	// Lower is a lower bound on the true count of Key, Count-Error; it is
+	// 0 for an unmonitored key
+	Lower int
+	// Error is the maximum overestimation of Count, Count-Lower
+	Error int
+	// Monitored is whether Key is monitored, i.e. returned by Keys
+	Monitored bool
+	// Guaranteed is whether Key is provably among the true top Rank+1 keys,
+	// as KeysWithGuarantee(Rank+1) would report it; it is false for an
+	// unmonitored key
+	Guaranteed bool
+	// Rank is the 0-based position of Key in Keys, or -1 if it is not
+	// monitored
+	Rank int
+}
+
+// Query returns everything known about x in one read: its bounds, whether it
+// is monitored, and its rank.  It does not modify the stream, so it is safe
+// to call concurrently with other reads, and takes time linear in n.
+func (s *Stream) Query(x string) QueryResult {
+	x = s.normalize(x)
+	e, monitored := s.monitored(x)
+	if !monitored {
+		if b, ok := s.buffered(x); ok {
+			return QueryResult{Key: x, Count: b.Count, Lower: b.Count, Rank: -1}
+		}
+		a := s.alpha(metro.Hash64Str(x, 0))
+		return QueryResult{Key: x, Count: a, Error: a, Rank: -1}
+	}
+
+	// rank x among the other elements, and find the one ranked after it
+	var (
+		rank int
+		next *Element
+	)
+	elts := s.elements()
+	for i := range elts {
+		o := &elts[i]
+		switch {
+		case o.Key == x:
+		case s.less(*o, e):
+			rank++
+		case next == nil || s.less(*o, *next):
+			next = o
+		}
+	}
+	bound := s.unmonitoredBound()
+	if next != nil && next.Count > bound {
+		bound = next.Count
+	}
+
+	return QueryResult{
+		Key:        x,
+		Count:      e.Count,
+		Lower:      e.Count - e.Error,
+		Error:      e.Error,
+		Monitored:  true,
+		Guaranteed: e.Count-e.Error > bound,
+		Rank:       rank,
+	}
+}
+
+// ToProto returns the monitored elements as a protobuf message, in the order
+// of Keys.  The alpha filter and optional state are not included, so the
+// message is meant for reading results rather than resuming the stream.
+func (s *Stream) ToProto() *topkpb.TopK {
+	keys := s.Keys()
+	m := &topkpb.TopK{N: int64(s.n), Elements: make([]topkpb.Element, len(keys))}
+	for i, e := range keys {
+		m.Elements[i] = topkpb.Element{Key: e.Key, Count: int64(e.Count), Error: int64(e.Error)}
+	}
+	return m
+}
+
+// FromProto returns a Stream holding the elements of m, as FromElements does.
+// It returns an error wrapping ErrInvalidN if m.N is not positive, too large
+// to allocate, or less than the number of elements.
+func FromProto(m *topkpb.TopK, opts ...Option) (*Stream, error) {
+	if m.N <= 0 || m.N > maxDecodedN || int64(len(m.Elements)) > m.N {
+		return nil, fmt.Errorf("%w: %d with %d elements", ErrInvalidN, m.N, len(m.Elements))
+	}
+	elts := make([]Element, len(m.Elements))
+	for i, e := range m.Elements {
+		elts[i] = Element{Key: e.Key, Count: int(e.Count), Error: int(e.Error)}
+	}
+	return FromElements(int(m.N), elts, opts...), nil
+}
+
+// maxDecodedN bounds the n of decoded messages and configurations, for
+// which New preallocates the heap and the filter
+const maxDecodedN = 1 << 26
+
+// EncodeMsgp ...
+func (s *Stream) EncodeMsgp(w *msgp.Writer) error {
+	return s.encodeMsgp(w, false)
+}
+
+func (s *Stream) encodeMsgp(w *msgp.Writer, sparse bool) error {
+	s.EndWarmup()
+	if s.store != nil {
+		return s.heapCopy().encodeMsgp(w, sparse)
+	}
+	if err := w.WriteInt(s.n); err != nil {
+		return err
+	}
+
+	if sparse {
+		if err := s.encodeSparseAlphas(w); err != nil {
+			return err
+		}
+	} else {
+		if err := w.WriteArrayHeader(uint32(s.alphaLen())); err != nil {
+			return err
+		}
+
+		for i := 0; i < s.alphaLen(); i++ {
+			if err := w.WriteInt(s.alphaAt(i)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := s.k.EncodeMsgp(w); err != nil {
+		return err
+	}
+
+	return s.encodeExtensions(w)
+}
+
+// encodeExtensions writes the optional fields of the stream as a trailing map
+// of field name to value.  Nothing is written if all of them are unset, so
+// such streams encode as before the fields were added.
+func (s *Stream) encodeExtensions(w *msgp.Writer) error {
+	var sz uint32
+	if s.hll != nil {
+		sz++
+	}
+	if s.total != 0 {
+		sz++
+	}
+	if s.inserts != 0 {
+		sz++
+	}
+	if s.alphas32 != nil {
+		sz++
+	}
+	if s.nofilter {
+		sz++
+	}
+	if s.k.epochs {
+		sz += 2
+	}
+	if s.k.hasValues() {
+		sz++
+	}
+	if s.k.hasHits() {
+		sz++
+	}
+	if s.k.hasSeen() {
+		sz++
+	}
+	if len(s.promoted) > 0 {
+		sz++
+	}
+	if sz == 0 {
+		return nil
+	}
+
+	if err := w.WriteMapHeader(sz); err != nil {
+		return err
+	}
+	if s.hll != nil {
+		if err := w.WriteString("hll"); err != nil {
+			return err
+		}
+		if err := w.WriteBytes(s.hll); err != nil {
+			return err
+		}
+	}
+	if s.total != 0 {
+		if err := w.WriteString("total"); err != nil {
+			return err
+		}
+		if err := w.WriteInt64(s.total); err != nil {
+			return err
+		}
+	}
+	if s.inserts != 0 {
+		if err := w.WriteString("inserts"); err != nil {
+			return err
+		}
+		if err := w.WriteInt64(s.inserts); err != nil {
+			return err
+		}
+	}
+	if s.alphas32 != nil {
+		if err := w.WriteString("uint32alphas"); err != nil {
+			return err
+		}
+		if err := w.WriteBool(true); err != nil {
+			return err
+		}
+	}
+	if s.nofilter {
+		if err := w.WriteString("nofilter"); err != nil {
+			return err
+		}
+		if err := w.WriteBool(true); err != nil {
+			return err
+		}
+	}
+	if s.k.epochs {
+		// the current epoch, and the epoch of each element in order
+		if err := w.WriteString("epoch"); err != nil {
+			return err
+		}
+		if err := w.WriteUint64(s.k.epoch); err != nil {
+			return err
+		}
+		if err := w.WriteString("epochs"); err != nil {
+			return err
+		}
+		if err := w.WriteArrayHeader(uint32(len(s.k.elts))); err != nil {
+			return err
+		}
+		for _, st := range s.k.stamps {
+			if err := w.WriteUint64(st.epoch); err != nil {
+				return err
+			}
+		}
+	}
+	if s.k.hasValues() {
+		// the Value of each element in order
+		if err := w.WriteString("values"); err != nil {
+			return err
+		}
+		if err := w.WriteArrayHeader(uint32(len(s.k.elts))); err != nil {
+			return err
+		}
+		for _, e := range s.k.elts {
+			if err := w.WriteInt64(e.Value); err != nil {
+				return err
+			}
+		}
+	}
+	if s.k.hasSeen() {
+		// the FirstSeen and LastSeen of each element in order
+		if err := w.WriteString("seen"); err != nil {
+			return err
+		}
+		if err := w.WriteArrayHeader(uint32(2 * len(s.k.elts))); err != nil {
+			return err
+		}
+		for _, e := range s.k.elts {
+			if err := w.WriteInt64(e.FirstSeen); err != nil {
+				return err
+			}
+			if err := w.WriteInt64(e.LastSeen); err != nil {
+				return err
+			}
+		}
+	}
+	if s.k.hasHits() {
+		// the Hits of each element in order
+		if err := w.WriteString("hits"); err != nil {
+			return err
+		}
+		if err := w.WriteArrayHeader(uint32(len(s.k.elts))); err != nil {
+			return err
+		}
+		for _, e := range s.k.elts {
+			if err := w.WriteInt64(e.Hits); err != nil {
+				return err
+			}
+		}
+	}
+	if len(s.promoted) > 0 {
+		if err := w.WriteString("promoted"); err != nil {
+			return err
+		}
+		if err := s.encodePromoted(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Stream) nonzeroAlphas() int {
+	nonzero := 0
+	for i := 0; i < s.alphaLen(); i++ {
+		if s.alphaAt(i) != 0 {
+			nonzero++
+		}
+	}
+	return nonzero
+}
+
+// encodeSparseAlphas writes the length of alphas followed by a map of the
+// indices of nonzero alphas to their values
+func (s *Stream) encodeSparseAlphas(w *msgp.Writer) error {
+	nonzero := s.nonzeroAlphas()
+
+	if err := w.WriteInt(s.alphaLen()); err != nil {
+		return err
+	}
+	if err := w.WriteMapHeader(uint32(nonzero)); err != nil {
+		return err
+	}
+	for i := 0; i < s.alphaLen(); i++ {
+		a := s.alphaAt(i)
+		if a == 0 {
+			continue
+		}
+		if err := w.WriteInt(i); err != nil {
+			return err
+		}
+		if err := w.WriteInt(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DecodeMsgp ...
+func (s *Stream) DecodeMsgp(r *msgp.Reader) error {
+	return s.decodeMsgp(r, false, false)
+}
+
+// DecodeMsgpReuse decodes into s like DecodeMsgp, but reuses the buffers of s
+// where possible: the alpha filter if its length matches the decoded one, and
+// the monitored elements and key index if they have enough capacity.  Other
+// buffers are allocated as usual.  This reduces garbage when repeatedly
+// reloading snapshots of the same size into one Stream.
+func (s *Stream) DecodeMsgpReuse(r *msgp.Reader) error {
+	return s.decodeMsgp(r, false, true)
+}
+
+func (s *Stream) decodeMsgp(r *msgp.Reader, sparse, reuse bool) (err error) {
+	if s.store != nil {
+		s.viaHeap(func() { err = s.decodeMsgp(r, sparse, reuse) })
+		return err
+	}
+	err = s.decodeFields(r, sparse, reuse)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %w", ErrTruncated, err)
+	}
+	return err
+}
+
+func (s *Stream) decodeFields(r *msgp.Reader, sparse, reuse bool) error {
+	var (
+		err error
+		sz  uint32
+	)
+
+	s.invalidate()
+	if s.n, err = r.ReadInt(); err != nil {
+		return err
+	}
+	if s.n < 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidN, s.n)
+	}
+
+	if sparse {
+		if err = s.decodeSparseAlphas(r, reuse); err != nil {
+			return err
+		}
+	} else {
+		if sz, err = r.ReadArrayHeader(); err != nil {
+			return err
+		}
+
+		if !reuse || len(s.alphas) != int(sz) {
+			s.alphas = make([]int, sz)
+		}
+		for i := range s.alphas {
+			if s.alphas[i], err = r.ReadInt(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err = s.k.decodeMsgp(r, reuse); err != nil {
+		return err
+	}
+	if len(s.k.elts) > s.n {
+		return fmt.Errorf("%w: %d elements exceed n %d", ErrInvalidN, len(s.k.elts), s.n)
+	}
+	if err = s.decodeExtensions(r); err != nil {
+		return err
+	}
+	if s.n == 0 && s.alphaLen() > 0 {
+		return fmt.Errorf("%w: zero with %d alphas", ErrInvalidN, s.alphaLen())
+	}
+	return nil
+}
+
+func (s *Stream) decodeExtensions(r *msgp.Reader) error {
+	s.alphas32 = nil
+	s.nofilter = false
+	s.k.epochs, s.k.epoch = false, 0
+	s.sideEpochs = nil
+	s.hll = nil
+	s.total, s.inserts = 0, 0
+	if s.promoted != nil {
+		s.promoted = make(map[string]Element)
+	}
+
+	if t, err := r.NextType(); err != nil || t != msgp.MapType {
+		// no optional fields
+		return nil
+	}
+
+	sz, err := r.ReadMapHeader()
+	if err != nil {
+		return err
+	}
+
+	for i := uint32(0); i < sz; i++ {
+		field, err := r.ReadString()
+		if err != nil {
+			return err
+		}
+
+		switch field {
+		case "hll":
+			b, err := r.ReadBytes(nil)
+			if err != nil {
+				return err
+			}
+			if len(b) != hllRegisters {
+				return fmt.Errorf("%w: expected cardinality sketch of size %d, got %d", ErrInconsistent, hllRegisters, len(b))
+			}
+			s.hll = b
+		case "total":
+			if s.total, err = r.ReadInt64(); err != nil {
+				return err
+			}
+		case "inserts":
+			if s.inserts, err = r.ReadInt64(); err != nil {
+				return err
+			}
+		case "uint32alphas":
+			narrow, err := r.ReadBool()
+			if err != nil {
+				return err
+			}
+			if narrow {
+				s.alphas32 = make([]uint32, len(s.alphas))
+				for i, a := range s.alphas {
+					s.setAlphaAt(i, a)
+				}
+				s.alphas = nil
+			}
+		case "nofilter":
+			if s.nofilter, err = r.ReadBool(); err != nil {
+				return err
+			}
+			if s.nofilter {
+				s.alphas, s.alphas32 = nil, nil
+			}
+		case "epoch":
+			s.k.epochs = true
+			if s.k.epoch, err = r.ReadUint64(); err != nil {
+				return err
+			}
+		case "epochs":
+			s.k.epochs = true
+			sz, err := r.ReadArrayHeader()
+			if err != nil {
+				return err
+			}
+			if int(sz) != len(s.k.elts) {
+				return fmt.Errorf("%w: expected %d element epochs, got %d", ErrInconsistent, len(s.k.elts), sz)
+			}
+			for i := range s.k.elts {
+				if s.k.stamps[i].epoch, err = r.ReadUint64(); err != nil {
+					return err
+				}
+			}
+		case "promoted":
+			if err = s.decodePromoted(r); err != nil {
+				return err
+			}
+		case "seen":
+			sz, err := r.ReadArrayHeader()
+			if err != nil {
+				return err
+			}
+			if int(sz) != 2*len(s.k.elts) {
+				return fmt.Errorf("%w: expected %d element observation times, got %d", ErrInconsistent, 2*len(s.k.elts), sz)
+			}
+			for i := range s.k.elts {
+				if s.k.elts[i].FirstSeen, err = r.ReadInt64(); err != nil {
+					return err
+				}
+				if s.k.elts[i].LastSeen, err = r.ReadInt64(); err != nil {
+					return err
+				}
+			}
+		case "hits":
+			sz, err := r.ReadArrayHeader()
+			if err != nil {
+				return err
+			}
+			if int(sz) != len(s.k.elts) {
+				return fmt.Errorf("%w: expected %d element hits, got %d", ErrInconsistent, len(s.k.elts), sz)
+			}
+			for i := range s.k.elts {
+				if s.k.elts[i].Hits, err = r.ReadInt64(); err != nil {
+					return err
+				}
+			}
+		case "values":
+			sz, err := r.ReadArrayHeader()
+			if err != nil {
+				return err
+			}
+			if int(sz) != len(s.k.elts) {
+				return fmt.Errorf("%w: expected %d element values, got %d", ErrInconsistent, len(s.k.elts), sz)
+			}
+			for i := range s.k.elts {
+				if s.k.elts[i].Value, err = r.ReadInt64(); err != nil {
+					return err
+				}
+			}
+		default:
+			// skip fields written by newer versions
+			if err = r.Skip(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Stream) decodeSparseAlphas(r *msgp.Reader, reuse bool) error {
+	n, err := r.ReadInt()
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		return fmt.Errorf("%w: invalid alphas length %d", ErrInconsistent, n)
+	}
+
+	sz, err := r.ReadMapHeader()
+	if err != nil {
+		return err
+	}
+
+	if reuse && len(s.alphas) == n {
+		for i := range s.alphas {
+			s.alphas[i] = 0
+		}
+	} else {
+		s.alphas = make([]int, n)
+	}
+	for i := uint32(0); i < sz; i++ {
+		idx, err := r.ReadInt()
+		if err != nil {
+			return err
+		}
+		if idx < 0 || idx >= n {
+			return fmt.Errorf("%w: alpha index %d out of range [0, %d)", ErrInconsistent, idx, n)
+		}
+		if s.alphas[idx], err = r.ReadInt(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Errors returned when decoding a Stream, wrapped with details of the failure
+// so they can be matched with errors.Is
+var (
+	// ErrVersion is returned for a gob payload of an unsupported version
+	ErrVersion = errors.New("topk: unsupported encoding version")
+	// ErrTruncated is returned when the input ends before the stream does
+	ErrTruncated = errors.New("topk: truncated encoding")
+	// ErrInconsistent is returned when the decoded parts of the stream
+	// contradict each other, such as an index not matching the elements
+	ErrInconsistent = errors.New("topk: inconsistent encoding")
+	// ErrInvalidN is returned for a negative or too large n, fewer than the
+	// number of encoded elements, or zero with a non-empty alpha filter
+	ErrInvalidN = errors.New("topk: invalid n")
+)
+
+// Encode ...
+func (s *Stream) Encode(w io.Writer) error {
+	wrt := msgp.NewWriter(w)
+	if err := s.EncodeMsgp(wrt); err != nil {
+		return err
+	}
+	return wrt.Flush()
+}
+
+// EncodeTop writes the stream as Encode does, but with only the m monitored
+// elements with the highest counts, for smaller snapshots of the leaders.
+// The other elements are recorded in the encoded alpha filter as if
+// TrimToTop(m) had been called, so estimates from the decoded stream remain
+// upper bounds; s itself is not modified, except that warm-up is ended as
+// Encode does.  Elements promoted WithExactAbove are always included.
+//
+// The decoded stream has the same n but fewer monitored elements, so it
+// admits new keys without eviction until it is full again and evolves
+// differently from s under further inserts.
+func (s *Stream) EncodeTop(w io.Writer, m int) error {
+	s.EndWarmup()
+	if s.store != nil {
+		return s.heapCopy().EncodeTop(w, m)
+	}
+	if m < 0 {
+		m = 0
+	}
+	if m >= len(s.k.elts) {
+		return s.Encode(w)
+	}
+
+	top := *s
+	top.alphas = append([]int(nil), s.alphas...)
+	top.alphas32 = append([]uint32(nil), s.alphas32...)
+	top.k = s.k.empty(len(s.k.elts))
+	for i, e := range s.k.elts {
+		top.k.m[e.Key] = i
+	}
+	top.k.elts = append(top.k.elts, s.k.elts...)
+	top.k.stamps = append(top.k.stamps, s.k.stamps...)
+	top.batch = false
+	top.TrimToTop(m)
+	return top.Encode(w)
+}
+
+// Decode ...
+func (s *Stream) Decode(r io.Reader) error {
 	rdr := msgp.NewReader(r)
 	return s.DecodeMsgp(rdr)
 }
+
+// DecodeReuse decodes into s like Decode, reusing its buffers as described
+// for DecodeMsgpReuse
+func (s *Stream) DecodeReuse(r io.Reader) error {
+	return s.DecodeMsgpReuse(msgp.NewReader(r))
+}
+
+// Versions of the GobEncode format, stored in its first byte
+const (
+	gobVersionDense  = 1 // the msgp encoding
+	gobVersionSparse = 2 // the msgp encoding with alphas stored sparsely
+)
+
+// GobEncode implements gob.GobEncoder.  The msgp encoding is prefixed with a
+// version byte, and alphas are stored as a sparse map of index to value when
+// fewer than half of them are nonzero.
+func (s *Stream) GobEncode() ([]byte, error) {
+	sparse := s.nonzeroAlphas() < s.alphaLen()/2
+
+	version := byte(gobVersionDense)
+	if sparse {
+		version = gobVersionSparse
+	}
+
+	buf := bytes.NewBuffer([]byte{version})
+	w := msgp.NewWriter(buf)
+	if err := s.encodeMsgp(w, sparse); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// GobDecode implements gob.GobDecoder
+func (s *Stream) GobDecode(b []byte) error {
+	if len(b) == 0 {
+		return fmt.Errorf("%w: empty gob payload", ErrTruncated)
+	}
+
+	var sparse bool
+	switch b[0] {
+	case gobVersionDense:
+	case gobVersionSparse:
+		sparse = true
+	default:
+		return fmt.Errorf("%w %d", ErrVersion, b[0])
+	}
+
+	return s.decodeMsgp(msgp.NewReader(bytes.NewReader(b[1:])), sparse, false)
+}
+
+// DecodeAllGob decodes consecutive gob-encoded streams from r until EOF, such
+// as an append-only log of snapshots.  Each snapshot must have been written
+// by its own gob.Encoder, as when a file is reopened for appending every
+// snapshot; a partially written trailing snapshot is reported as
+// ErrTruncated along with the streams decoded before it.
+func DecodeAllGob(r io.Reader) ([]*Stream, error) {
+	// a gob.Decoder reading from an io.ByteReader does not read ahead, so
+	// each snapshot can be decoded with a fresh decoder
+	br := bufio.NewReader(r)
+	var streams []*Stream
+	for {
+		s := &Stream{}
+		err := gob.NewDecoder(br).Decode(s)
+		if err == io.EOF {
+			return streams, nil
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return streams, fmt.Errorf("%w: snapshot %d: %w", ErrTruncated, len(streams), err)
+		}
+		if err != nil {
+			return streams, fmt.Errorf("snapshot %d: %w", len(streams), err)
+		}
+		streams = append(streams, s)
+	}
+}
@@ -3,6 +3,11 @@ package topk
 import (
 	"bufio"
 	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -10,11 +15,20 @@ import (
 	"math/rand"
 	"os"
 	"reflect"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unsafe"
 
+	"github.com/axiomhq/topk/topkpb"
+	"github.com/dgryski/go-metro"
 	"github.com/stretchr/testify/assert"
+	"github.com/tinylib/msgp/msgp"
 )
 
 type freqs struct {
@@ -435,3 +449,3082 @@ func TestMarshalUnMarshal(t *testing.T) {
 	assert.EqualValues(t, sketch, tmp)
 
 }
+
+func TestResetN(t *testing.T) {
+	words := loadWords()
+
+	tk := New(100)
+	for _, w := range words {
+		tk.Insert(w, 1)
+	}
+
+	alphas := &tk.alphas[:1][0]
+	tk.ResetN(50)
+	assert.Equal(t, 50, tk.n)
+	assert.Empty(t, tk.Keys())
+	assert.True(t, alphas == &tk.alphas[:1][0], "alphas should be reused when shrinking")
+
+	fresh := New(50)
+	for _, w := range words {
+		tk.Insert(w, 1)
+		fresh.Insert(w, 1)
+	}
+	assert.Equal(t, fresh.Keys(), tk.Keys())
+
+	tk.ResetN(200)
+	assert.Len(t, tk.alphas, 200*alphaRatio)
+	assert.Empty(t, tk.Keys())
+}
+
+func TestEstimateRange(t *testing.T) {
+	tk := New(2)
+	tk.Insert("a", 10)
+	tk.Insert("b", 5)
+	tk.Insert("c", 1)
+
+	low, high := tk.EstimateRange("a")
+	assert.Equal(t, 10, low)
+	assert.Equal(t, 10, high)
+
+	e := tk.Estimate("c")
+	low, high = tk.EstimateRange("c")
+	assert.Equal(t, 0, low)
+	assert.Equal(t, e.Count, high)
+}
+
+func TestAtomicStream(t *testing.T) {
+	as := NewAtomicStream(New(10))
+	as.Insert("a", 1)
+	assert.Equal(t, []Element{{Key: "a", Count: 1}}, as.Keys())
+
+	next := New(10)
+	next.Insert("b", 2)
+	as.Store(next)
+	assert.True(t, as.Load() == next)
+	assert.Equal(t, []Element{{Key: "b", Count: 2}}, as.Keys())
+
+	// the zero value holds a zero Stream until one is stored
+	var zero AtomicStream
+	assert.Equal(t, Element{Key: "a", Count: 1}, zero.Insert("a", 1))
+	assert.Empty(t, zero.Keys())
+	assert.NotNil(t, zero.Load())
+	zero.Store(next)
+	assert.True(t, zero.Load() == next)
+}
+
+func TestConservativeUpdate(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	zipf := rand.NewZipf(r, 1.1, 1, 100000)
+
+	plain := New(50)
+	cu := New(50, WithConservativeUpdate())
+	exact := make(map[string]int)
+
+	for i := 0; i < 200000; i++ {
+		w := fmt.Sprintf("word-%d", zipf.Uint64())
+		exact[w]++
+		plain.Insert(w, 1)
+		cu.Insert(w, 1)
+	}
+
+	for k, v := range exact {
+		if e := cu.Estimate(k); e.Count < v {
+			t.Errorf("estimate lower than exact: key=%v, exact=%v, estimate=%v", k, v, e.Count)
+		}
+	}
+
+	// compare the overestimation of the monitored elements
+	var plainErr, cuErr int
+	for _, e := range plain.Keys() {
+		plainErr += e.Count - exact[e.Key]
+	}
+	for _, e := range cu.Keys() {
+		cuErr += e.Count - exact[e.Key]
+	}
+
+	if cuErr >= plainErr {
+		t.Errorf("conservative update error %d not lower than plain error %d", cuErr, plainErr)
+	}
+}
+
+func TestWriteKeysJSON(t *testing.T) {
+	tk := New(100)
+	for _, w := range loadWords() {
+		tk.Insert(w, 1)
+	}
+
+	for _, m := range []int{0, 10, 100, 1000} {
+		buf := bytes.NewBuffer(nil)
+		assert.NoError(t, tk.WriteKeysJSON(buf, m))
+
+		var got []Element
+		assert.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+
+		want := tk.Keys()
+		if m < len(want) {
+			want = want[:m]
+		}
+		assert.Equal(t, want, append([]Element{}, got...))
+	}
+
+	buf := bytes.NewBuffer(nil)
+	assert.NoError(t, tk.WriteKeysJSON(buf, -1))
+	assert.Equal(t, "[]", buf.String())
+}
+
+func TestDecodeDuplicateKey(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w := msgp.NewWriter(buf)
+	assert.NoError(t, w.WriteInt(1))
+	assert.NoError(t, w.WriteArrayHeader(alphaRatio))
+	for i := 0; i < alphaRatio; i++ {
+		assert.NoError(t, w.WriteInt(0))
+	}
+	assert.NoError(t, w.WriteMapHeader(1))
+	assert.NoError(t, w.WriteString("a"))
+	assert.NoError(t, w.WriteInt(0))
+	assert.NoError(t, w.WriteArrayHeader(2))
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, w.WriteString("a"))
+		assert.NoError(t, w.WriteInt(1))
+		assert.NoError(t, w.WriteInt(0))
+	}
+	assert.NoError(t, w.Flush())
+
+	tk := &Stream{}
+	assert.Error(t, tk.Decode(buf))
+}
+
+func TestSample(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+
+	tk := New(10)
+	_, ok := tk.Sample(rng)
+	assert.False(t, ok)
+
+	tk.Insert("a", 3)
+	tk.Insert("b", 1)
+
+	hits := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		k, ok := tk.Sample(rng)
+		assert.True(t, ok)
+		hits[k]++
+	}
+	assert.InDelta(t, 0.75, float64(hits["a"])/10000, 0.02)
+	assert.InDelta(t, 0.25, float64(hits["b"])/10000, 0.02)
+
+	// the distribution is rebuilt after the counts change
+	tk.Insert("c", 996)
+	hits = make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		k, _ := tk.Sample(rng)
+		hits[k]++
+	}
+	assert.InDelta(t, 0.996, float64(hits["c"])/10000, 0.01)
+}
+
+func TestWalkHeap(t *testing.T) {
+	tk := New(100)
+	for _, w := range loadWords() {
+		tk.Insert(w, 1)
+	}
+
+	var visited int
+	err := tk.WalkHeap(func(idx, parent int, e Element) {
+		assert.Equal(t, visited, idx)
+		if idx == 0 {
+			assert.Equal(t, -1, parent)
+		} else {
+			assert.Equal(t, (idx-1)/2, parent)
+		}
+		visited++
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, len(tk.k.elts), visited)
+
+	// put the maximum at the root
+	last := len(tk.k.elts) - 1
+	tk.k.Swap(0, last)
+	assert.Error(t, tk.WalkHeap(nil))
+}
+
+func TestUpdateMode(t *testing.T) {
+	tk := New(2)
+	_, err := tk.Update("a", 5)
+	assert.NoError(t, err)
+	_, err = tk.Update("a", -1)
+	assert.Equal(t, ErrNegativeCount, err)
+	assert.Equal(t, 5, tk.Estimate("a").Count)
+
+	tk = New(2, WithMode(Signed))
+	tk.Insert("a", 5)
+	tk.Insert("b", 3)
+	tk.Insert("c", 1)
+
+	e, err := tk.Update("a", -4)
+	assert.NoError(t, err)
+	assert.Equal(t, Element{Key: "a", Count: 1}, e)
+	assert.Equal(t, "a", tk.k.elts[0].Key)
+
+	before := append([]int(nil), tk.alphas...)
+	_, err = tk.Update("c", -1)
+	assert.NoError(t, err)
+	assert.Equal(t, before, tk.alphas)
+	assert.NoError(t, tk.WalkHeap(nil))
+
+	// InsertChecked handles negative counts as Update does
+	tk = New(2, WithSafeMode())
+	tk.Insert("a", 5)
+	_, err = tk.InsertChecked("a", -7)
+	assert.Equal(t, ErrNegativeCount, err)
+	assert.Equal(t, Element{Key: "a", Count: 5}, tk.Estimate("a"))
+
+	tk = New(2, WithMode(Signed))
+	tk.Insert("a", 5)
+	e, err = tk.InsertChecked("a", -2)
+	assert.NoError(t, err)
+	assert.Equal(t, Element{Key: "a", Count: 3}, e)
+}
+
+func TestCardinality(t *testing.T) {
+	assert.Zero(t, New(10).Cardinality())
+
+	tk := New(10, WithCardinality())
+	for i := 0; i < 100000; i++ {
+		tk.Insert(fmt.Sprintf("key-%d", i%50000), 1)
+	}
+	assert.InEpsilon(t, 50000, tk.Cardinality(), 0.02)
+
+	other := New(10, WithCardinality())
+	for i := 0; i < 100000; i++ {
+		other.Insert(fmt.Sprintf("key-%d", 25000+i%50000), 1)
+	}
+	assert.NoError(t, tk.Merge(other))
+	assert.InEpsilon(t, 75000, tk.Cardinality(), 0.02)
+
+	buf := bytes.NewBuffer(nil)
+	assert.NoError(t, tk.Encode(buf))
+	decoded := &Stream{}
+	assert.NoError(t, decoded.Decode(buf))
+	assert.Equal(t, tk.Cardinality(), decoded.Cardinality())
+}
+
+func TestKeysMatching(t *testing.T) {
+	tk := New(100)
+	for _, w := range loadWords() {
+		tk.Insert(w, 1)
+	}
+
+	pred := func(key string) bool { return strings.HasPrefix(key, "a") }
+
+	var want []Element
+	for _, e := range tk.Keys() {
+		if pred(e.Key) {
+			want = append(want, e)
+		}
+	}
+	assert.Equal(t, want, tk.KeysMatching(pred))
+}
+
+func TestGobEncodeDecode(t *testing.T) {
+	sparse := New(1000)
+	for _, w := range loadWords()[:500] {
+		sparse.Insert(w, 1)
+	}
+
+	dense := New(10)
+	for _, w := range loadWords() {
+		dense.Insert(w, 1)
+	}
+
+	for _, tk := range []*Stream{New(10), sparse, dense} {
+		b, err := tk.GobEncode()
+		assert.NoError(t, err)
+
+		buf := bytes.NewBuffer(nil)
+		assert.NoError(t, gob.NewEncoder(buf).Encode(tk))
+
+		decoded := &Stream{}
+		assert.NoError(t, gob.NewDecoder(buf).Decode(decoded))
+		assert.Equal(t, tk, decoded)
+
+		if tk == dense {
+			assert.Equal(t, byte(gobVersionDense), b[0])
+		} else {
+			assert.Equal(t, byte(gobVersionSparse), b[0])
+		}
+	}
+}
+
+func TestSet(t *testing.T) {
+	tk := New(2)
+	tk.Insert("a", 5)
+	tk.Insert("b", 3)
+	tk.Insert("c", 4) // replaces b
+
+	assert.Equal(t, Element{Key: "c", Count: 2}, tk.Set("c", 2))
+	assert.Equal(t, "c", tk.k.elts[0].Key)
+	assert.Equal(t, Element{Key: "c", Count: 9}, tk.Set("c", 9))
+	assert.Equal(t, "a", tk.k.elts[0].Key)
+	assert.NoError(t, tk.WalkHeap(nil))
+
+	// untracked keys are inserted
+	tk = New(2)
+	assert.Equal(t, Element{Key: "a", Count: 7}, tk.Set("a", 7))
+}
+
+// containerHeap adapts keys to container/heap as a reference implementation
+type containerHeap struct{ *keys }
+
+func (h containerHeap) Push(x interface{}) {
+	e := x.(Element)
+	h.m[e.Key] = len(h.elts)
+	h.elts = append(h.elts, e)
+	h.stamps = append(h.stamps, stamp{})
+}
+
+func (h containerHeap) Pop() interface{} {
+	e := h.elts[len(h.elts)-1]
+	h.elts = h.elts[:len(h.elts)-1]
+	h.stamps = h.stamps[:len(h.stamps)-1]
+	delete(h.m, e.Key)
+	return e
+}
+
+func TestHeapParity(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+
+	for round := 0; round < 100; round++ {
+		got := &keys{m: make(map[string]int)}
+		want := &keys{m: make(map[string]int)}
+
+		for i := 0; i < 200; i++ {
+			if len(got.elts) > 0 && r.Intn(2) == 0 {
+				idx := r.Intn(len(got.elts))
+				delta := r.Intn(20) - 5
+				got.elts[idx].Count += delta
+				want.elts[idx].Count += delta
+				got.fix(idx)
+				heap.Fix(containerHeap{want}, idx)
+			} else {
+				e := Element{Key: fmt.Sprintf("key-%d", i), Count: r.Intn(50), Error: r.Intn(5)}
+				got.push(e, stamp{})
+				heap.Push(containerHeap{want}, e)
+			}
+			assert.Equal(t, want, got)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	assert.Equal(t, Stats{N: 3}, New(3).Stats())
+
+	tk := New(3)
+	tk.Insert("a", 5)
+	tk.Insert("b", 2)
+	tk.Insert("c", 1)
+	tk.Insert("d", 4) // replaces c
+	tk.Insert("a", 1)
+
+	assert.Equal(t, Stats{
+		N:        3,
+		Tracked:  3,
+		Total:    13,
+		Inserts:  5,
+		MinCount: 2,
+		MaxCount: 6,
+		MaxError: tk.Estimate("d").Error,
+	}, tk.Stats())
+}
+
+func TestMergeAlphaRatio(t *testing.T) {
+	words := loadWords()
+	half := len(words) / 2
+
+	for _, ratios := range [][2]int{{6, 12}, {12, 6}} {
+		tk1 := New(50, WithAlphaRatio(ratios[0]))
+		tk2 := New(50, WithAlphaRatio(ratios[1]))
+		exact := exactCount(words)
+
+		for _, w := range words[:half] {
+			tk1.Insert(w, 1)
+		}
+		for _, w := range words[half:] {
+			tk2.Insert(w, 1)
+		}
+
+		assert.NoError(t, tk1.Merge(tk2))
+		assert.Len(t, tk1.alphas, 50*ratios[0])
+
+		for k, v := range exact {
+			if e := tk1.Estimate(k); e.Count < v {
+				t.Errorf("estimate lower than exact: ratios=%v key=%v, exact=%v, estimate=%v", ratios, k, v, e.Count)
+			}
+		}
+	}
+}
+
+func TestDrain(t *testing.T) {
+	tk := New(100)
+	for _, w := range loadWords() {
+		tk.Insert(w, 1)
+	}
+
+	want := tk.Keys()
+	assert.Equal(t, want, tk.Drain())
+	assert.Empty(t, tk.Keys())
+	assert.Equal(t, New(100), tk)
+}
+
+func TestForEachAbove(t *testing.T) {
+	tk := New(100)
+	for _, w := range loadWords() {
+		tk.Insert(w, 1)
+	}
+
+	threshold := tk.Keys()[10].Count
+
+	var got []Element
+	tk.ForEachAbove(threshold, func(e Element) {
+		got = append(got, e)
+	})
+	sort.Sort(elementsByCountDescending(got))
+
+	var want []Element
+	for _, e := range tk.Keys() {
+		if e.Count > threshold {
+			want = append(want, e)
+		}
+	}
+	assert.Equal(t, want, got)
+}
+
+func TestUint32Alphas(t *testing.T) {
+	words := loadWords()
+
+	wide := New(100)
+	narrow := New(100, WithUint32Alphas())
+	for _, w := range words {
+		wide.Insert(w, 1)
+		narrow.Insert(w, 1)
+	}
+	assert.Nil(t, narrow.alphas)
+	assert.Equal(t, wide.Keys(), narrow.Keys())
+
+	// the layout does not depend on the order of the options
+	for _, tk := range []*Stream{
+		New(10, WithUint32Alphas(), WithAlphaRatio(3)),
+		New(10, WithAlphaRatio(3), WithUint32Alphas()),
+	} {
+		assert.Nil(t, tk.alphas)
+		assert.Len(t, tk.alphas32, 30)
+	}
+	for _, tk := range []*Stream{
+		New(10, WithoutFilter(), WithAlphaRatio(3), WithUint32Alphas()),
+		New(10, WithAlphaRatio(3), WithUint32Alphas(), WithoutFilter()),
+	} {
+		assert.Zero(t, tk.alphaLen())
+	}
+	for _, w := range words {
+		assert.Equal(t, wide.Estimate(w), narrow.Estimate(w))
+	}
+
+	buf := bytes.NewBuffer(nil)
+	assert.NoError(t, narrow.Encode(buf))
+	decoded := &Stream{}
+	assert.NoError(t, decoded.Decode(buf))
+	assert.Equal(t, narrow, decoded)
+
+	// filter counts saturate
+	tk := New(1, WithUint32Alphas())
+	tk.Insert("a", 2*math.MaxUint32)
+	tk.Insert("b", math.MaxUint32)
+	tk.Insert("b", 10)
+	assert.Equal(t, math.MaxUint32, tk.Estimate("b").Count)
+}
+
+func BenchmarkNew(b *testing.B) {
+	for _, narrow := range []bool{false, true} {
+		b.Run(fmt.Sprintf("uint32=%v", narrow), func(b *testing.B) {
+			var opts []Option
+			if narrow {
+				opts = append(opts, WithUint32Alphas())
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				New(100000, opts...)
+			}
+		})
+	}
+}
+
+func TestFromElements(t *testing.T) {
+	tk := New(100)
+	for _, w := range loadWords() {
+		tk.Insert(w, 1)
+	}
+
+	restored := FromElements(100, tk.Keys())
+	assert.Equal(t, tk.Keys(), restored.Keys())
+	assert.NoError(t, restored.WalkHeap(nil))
+	for _, e := range tk.Keys() {
+		assert.Equal(t, e, restored.Estimate(e.Key))
+	}
+
+	// only the top n are monitored, the rest go to the filter
+	small := FromElements(10, tk.Keys())
+	assert.Equal(t, tk.Keys()[:10], small.Keys())
+	dropped := tk.Keys()[50]
+	assert.GreaterOrEqual(t, small.Estimate(dropped.Key).Count, dropped.Count)
+
+	// repeated keys are summed
+	dup := FromElements(10, []Element{{Key: "a", Count: 3, Error: 1}, {Key: "a", Count: 2}})
+	assert.Equal(t, []Element{{Key: "a", Count: 5, Error: 1}}, dup.Keys())
+}
+
+func TestRecencyEviction(t *testing.T) {
+	burst := func(tk *Stream) {
+		for _, k := range []string{"a", "b", "c", "x", "y"} {
+			tk.Insert(k, 1)
+		}
+	}
+
+	// without recency the just admitted x sits at the root and is evicted
+	plain := New(3)
+	burst(plain)
+	_, ok := plain.k.m["x"]
+	assert.False(t, ok)
+
+	tk := New(3, WithRecencyEviction())
+	burst(tk)
+	_, ok = tk.k.m["x"]
+	assert.True(t, ok)
+	_, ok = tk.k.m["b"]
+	assert.False(t, ok, "the least recently updated key should be evicted")
+	assert.NoError(t, tk.WalkHeap(nil))
+
+	// a surging key survives a stream of one-off keys
+	tk = New(10, WithRecencyEviction())
+	for i := 0; i < 1000; i++ {
+		tk.Insert(fmt.Sprintf("once-%d", i), 1)
+		if i%3 == 0 {
+			tk.Insert("surge", 1)
+		}
+	}
+	assert.Equal(t, "surge", tk.Keys()[0].Key)
+}
+
+func TestTrimToTop(t *testing.T) {
+	tk := New(100)
+	for _, w := range loadWords() {
+		tk.Insert(w, 1)
+	}
+	keys := tk.Keys()
+
+	tk.TrimToTop(10)
+	assert.Equal(t, keys[:10], tk.Keys())
+	assert.Len(t, tk.k.m, 10)
+	for k, i := range tk.k.m {
+		assert.Equal(t, k, tk.k.elts[i].Key)
+	}
+	assert.NoError(t, tk.WalkHeap(nil))
+
+	for _, e := range keys[10:] {
+		assert.GreaterOrEqual(t, tk.Estimate(e.Key).Count, e.Count)
+	}
+
+	tk.TrimToTop(20)
+	assert.Equal(t, keys[:10], tk.Keys())
+}
+
+func TestIsFull(t *testing.T) {
+	tk := New(2)
+	assert.False(t, tk.IsFull())
+	tk.Insert("a", 1)
+	tk.Insert("a", 1)
+	assert.False(t, tk.IsFull())
+	tk.Insert("b", 1)
+	assert.True(t, tk.IsFull())
+}
+
+func TestFingerprint(t *testing.T) {
+	tk := New(100)
+	for _, w := range loadWords() {
+		tk.Insert(w, 1)
+	}
+
+	restored := FromElements(100, tk.Keys())
+	assert.NotEqual(t, tk.k.elts, restored.k.elts)
+	assert.Equal(t, tk.Fingerprint(), restored.Fingerprint())
+
+	assert.NotEqual(t, tk.Fingerprint(), FromElements(101, tk.Keys()).Fingerprint())
+
+	tk.Insert(tk.Keys()[0].Key, 1)
+	assert.NotEqual(t, tk.Fingerprint(), restored.Fingerprint())
+}
+
+func TestExactCounts(t *testing.T) {
+	_, ok := New(10).ExactCount("a")
+	assert.False(t, ok)
+
+	words := loadWords()
+	tk := New(100, WithExactCounts())
+	for _, w := range words {
+		tk.Insert(w, 1)
+	}
+
+	for w, v := range exactCount(words) {
+		c, ok := tk.ExactCount(w)
+		assert.True(t, ok)
+		assert.Equal(t, v, c)
+		if e := tk.Estimate(w); e.Count < c {
+			t.Errorf("estimate lower than exact: key=%v, exact=%v, estimate=%v", w, c, e.Count)
+		}
+	}
+
+	tk.Clear()
+	c, ok := tk.ExactCount(words[0])
+	assert.True(t, ok)
+	assert.Zero(t, c)
+}
+
+func TestInsertElement(t *testing.T) {
+	tk := New(2)
+	assert.Equal(t, Element{Key: "a", Count: 10, Error: 2}, tk.InsertElement(Element{Key: "a", Count: 10, Error: 2}))
+	assert.Equal(t, Element{Key: "a", Count: 15, Error: 3}, tk.InsertElement(Element{Key: "a", Count: 5, Error: 1}))
+	tk.InsertElement(Element{Key: "b", Count: 8, Error: 4})
+
+	// below the minimum it goes to the filter
+	e := tk.InsertElement(Element{Key: "c", Count: 3, Error: 1})
+	assert.Equal(t, 3, e.Count-e.Error)
+	_, ok := tk.k.m["c"]
+	assert.False(t, ok)
+
+	// above the minimum it replaces it, keeping its error
+	assert.Equal(t, Element{Key: "d", Count: 20, Error: 5}, tk.InsertElement(Element{Key: "d", Count: 20, Error: 5}))
+	assert.Equal(t, []Element{{Key: "d", Count: 20, Error: 5}, {Key: "a", Count: 15, Error: 3}}, tk.Keys())
+}
+
+func TestLockedStreamSnapshot(t *testing.T) {
+	ls := NewLocked(100)
+	assert.Empty(t, ls.SnapshotKeys())
+
+	words := loadWords()
+	var wg sync.WaitGroup
+	for _, part := range split(words, 4) {
+		wg.Add(1)
+		go func(part []string) {
+			defer wg.Done()
+			for _, w := range part {
+				ls.Insert(w, 1)
+			}
+		}(part)
+	}
+
+	stop := ls.RefreshEvery(time.Millisecond)
+	wg.Wait()
+	stop()
+
+	ls.Refresh()
+	assert.Equal(t, ls.Keys(), ls.SnapshotKeys())
+	assert.Equal(t, ls.Stats(), ls.SnapshotStats())
+	assert.Equal(t, int64(len(words)), ls.SnapshotStats().Total)
+}
+
+func TestInterner(t *testing.T) {
+	in := NewInterner()
+	tk1 := New(10, WithInterner(in), WithoutKeyCopy())
+	tk2 := New(10, WithInterner(in), WithoutKeyCopy())
+
+	// distinct allocations of the same key
+	k1 := strings.Repeat("k", 8)
+	k2 := strings.Repeat("k", 8)
+	assert.False(t, unsafe.StringData(k1) == unsafe.StringData(k2))
+
+	tk1.Insert(k1, 1)
+	tk2.Insert(k2, 1)
+	assert.True(t, unsafe.StringData(tk1.k.elts[0].Key) == unsafe.StringData(tk2.k.elts[0].Key))
+	assert.Equal(t, 1, in.Len())
+
+	assert.NoError(t, tk1.Merge(tk2))
+	assert.True(t, unsafe.StringData(tk1.k.elts[0].Key) == unsafe.StringData(k1))
+}
+
+func TestEstimateDebug(t *testing.T) {
+	tk := New(1)
+	tk.Insert("a", 10)
+	tk.Insert("b", 3)
+
+	e, monitored, alpha := tk.EstimateDebug("a")
+	assert.Equal(t, tk.Estimate("a"), e)
+	assert.True(t, monitored)
+	assert.Equal(t, tk.alpha(metro.Hash64Str("a", 0)), alpha)
+
+	e, monitored, alpha = tk.EstimateDebug("b")
+	assert.Equal(t, tk.Estimate("b"), e)
+	assert.False(t, monitored)
+	assert.Equal(t, 3, alpha)
+}
+
+func BenchmarkWarmup(b *testing.B) {
+	const n = 100000
+	words := make([]string, n)
+	for i := range words {
+		words[i] = fmt.Sprintf("word-%d", i)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tk := New(n)
+		for _, w := range words {
+			tk.Insert(w, 1)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	tk := New(100)
+	for _, w := range loadWords() {
+		tk.Insert(w, 1)
+	}
+
+	tk.TrimToTop(10)
+	keys := tk.Keys()
+	assert.Equal(t, 100, cap(tk.k.elts))
+
+	tk.Compact()
+	assert.Equal(t, 10, cap(tk.k.elts))
+	assert.Equal(t, keys, tk.Keys())
+	assert.NoError(t, tk.WalkHeap(nil))
+	for k, i := range tk.k.m {
+		assert.Equal(t, k, tk.k.elts[i].Key)
+	}
+
+	tk.Insert("new", 1000)
+	assert.Equal(t, "new", tk.Keys()[0].Key)
+}
+
+func TestScaleRounding(t *testing.T) {
+	for _, tc := range []struct {
+		mode Rounding
+		want []int
+	}{
+		{RoundHalfUp, []int{3, 2, 1, 0}},
+		{RoundFloor, []int{3, 1, 0, 0}},
+		{RoundCeil, []int{3, 2, 1, 1}},
+	} {
+		var opts []Option
+		if tc.mode != RoundHalfUp {
+			opts = append(opts, WithRounding(tc.mode))
+		}
+		tk := New(10, opts...)
+		for i, c := range []int{10, 5, 3, 1} {
+			tk.Insert(fmt.Sprintf("key-%d", i), c)
+		}
+
+		tk.Scale(0.3)
+		var got []int
+		for _, e := range tk.Keys() {
+			got = append(got, e.Count)
+		}
+		assert.Equal(t, tc.want, got, "rounding mode %d", tc.mode)
+		assert.NoError(t, tk.WalkHeap(nil))
+	}
+}
+
+func TestEstimateBytes(t *testing.T) {
+	words := loadWords()
+	tk := New(100)
+	for _, w := range words {
+		tk.Insert(w, 1)
+	}
+
+	for _, w := range words[:1000] {
+		assert.Equal(t, tk.Estimate(w), tk.EstimateBytes([]byte(w)))
+	}
+
+	key := []byte(tk.Keys()[0].Key)
+	allocs := testing.AllocsPerRun(100, func() {
+		tk.EstimateBytes(key)
+	})
+	assert.Zero(t, allocs)
+}
+
+func TestWithoutFilter(t *testing.T) {
+	tk := New(2, WithoutFilter())
+	assert.Nil(t, tk.alphas)
+
+	tk.Insert("a", 5)
+	tk.Insert("b", 3)
+	assert.Equal(t, Element{Key: "c", Count: 4, Error: 3}, tk.Insert("c", 1))
+	assert.Equal(t, []Element{{Key: "a", Count: 5}, {Key: "c", Count: 4, Error: 3}}, tk.Keys())
+	assert.Equal(t, Element{Key: "b", Count: 4, Error: 4}, tk.Estimate("b"))
+
+	words := loadWords()
+	tk = New(100, WithoutFilter())
+	for _, w := range words {
+		tk.Insert(w, 1)
+	}
+	for w, v := range exactCount(words) {
+		e := tk.Estimate(w)
+		if e.Count < v {
+			t.Errorf("estimate lower than exact: key=%v, exact=%v, estimate=%v", w, v, e.Count)
+		}
+		if e.Count-e.Error > v {
+			t.Errorf("error bounds too large: key=%v, count=%v, error=%v, exact=%v", w, e.Count, e.Error, v)
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	assert.NoError(t, tk.Encode(buf))
+	decoded := &Stream{}
+	assert.NoError(t, decoded.Decode(buf))
+	assert.Equal(t, tk, decoded)
+}
+
+func TestMergeIntoWithoutFilter(t *testing.T) {
+	filtered := New(2)
+	filtered.Insert("a", 5)
+	filtered.Insert("b", 3)
+	filtered.Insert("c", 1)
+
+	tk := New(2, WithoutFilter())
+	tk.Insert("a", 2)
+	assert.NoError(t, tk.Merge(filtered))
+	assert.Nil(t, tk.alphas)
+	assert.Zero(t, tk.alphaLen())
+	assert.Equal(t, []Element{{Key: "a", Count: 7}, {Key: "b", Count: 3}}, tk.Keys())
+}
+
+func TestInsertReplace(t *testing.T) {
+	tk := New(2)
+	_, _, didEvict := tk.InsertReplace("a", 5)
+	assert.False(t, didEvict)
+	tk.InsertReplace("b", 3)
+	_, _, didEvict = tk.InsertReplace("a", 1)
+	assert.False(t, didEvict)
+
+	// filtered
+	_, _, didEvict = tk.InsertReplace("c", 1)
+	assert.False(t, didEvict)
+
+	current, evicted, didEvict := tk.InsertReplace("d", 5)
+	assert.True(t, didEvict)
+	assert.Equal(t, Element{Key: "b", Count: 3}, evicted)
+	assert.Equal(t, tk.Estimate("d"), current)
+}
+
+func TestEpochs(t *testing.T) {
+	tk := New(10, WithEpochs())
+	tk.Insert("a", 5)
+	tk.Insert("b", 3)
+
+	epoch := tk.NewEpoch()
+	tk.Insert("b", 1)
+	tk.Insert("c", 1)
+
+	assert.Equal(t, []Element{{Key: "b", Count: 4}, {Key: "c", Count: 1}}, tk.KeysSince(epoch))
+	assert.Len(t, tk.KeysSince(0), 3)
+
+	buf := bytes.NewBuffer(nil)
+	assert.NoError(t, tk.Encode(buf))
+	decoded := &Stream{}
+	assert.NoError(t, decoded.Decode(buf))
+	assert.Equal(t, tk, decoded)
+	assert.Equal(t, tk.KeysSince(epoch), decoded.KeysSince(epoch))
+
+	// promoted and trimmed elements keep their epochs
+	tk = New(10, WithEpochs(), WithExactAbove(10, 1))
+	tk.Insert("a", 20)
+	tk.Insert("b", 1)
+	tk.Insert("c", 2)
+	epoch = tk.NewEpoch()
+	tk.Insert("a", 1)
+	tk.Insert("c", 1)
+	tk.TrimToTop(1)
+	assert.Equal(t, []Element{{Key: "a", Count: 21}, {Key: "c", Count: 3}}, tk.KeysSince(epoch))
+	assert.Len(t, tk.KeysSince(0), 2)
+}
+
+func TestPeekMin(t *testing.T) {
+	tk := New(100)
+	_, ok := tk.PeekMin()
+	assert.False(t, ok)
+
+	for _, w := range loadWords() {
+		tk.Insert(w, 1)
+	}
+
+	keys := tk.Keys()
+	min, ok := tk.PeekMin()
+	assert.True(t, ok)
+	assert.Equal(t, keys[len(keys)-1].Count, min.Count)
+
+	_, evicted, didEvict := tk.InsertReplace("new", min.Count)
+	assert.True(t, didEvict)
+	assert.Equal(t, min, evicted)
+}
+
+func TestDroppedKeysCollectable(t *testing.T) {
+	// keys must be large enough to not be batched by the tiny allocator
+	var collected int32
+	insertKeys := func(tk *Stream, n int) {
+		for i := 0; i < n; i++ {
+			key := fmt.Sprintf("%064d", i)
+			runtime.SetFinalizer(unsafe.StringData(key), func(*byte) {
+				atomic.AddInt32(&collected, 1)
+			})
+			tk.Insert(key, n-i)
+		}
+	}
+	waitCollected := func(want int32) bool {
+		for i := 0; i < 10 && atomic.LoadInt32(&collected) < want; i++ {
+			runtime.GC()
+			time.Sleep(time.Millisecond)
+		}
+		return atomic.LoadInt32(&collected) >= want
+	}
+
+	// keys are not copied, so the stream holds the finalized strings
+	tk := New(10, WithoutKeyCopy())
+	insertKeys(tk, 10)
+	tk.Clear()
+	assert.True(t, waitCollected(10), "keys retained after Clear")
+
+	atomic.StoreInt32(&collected, 0)
+	insertKeys(tk, 10)
+	tk.TrimToTop(2)
+	assert.True(t, waitCollected(8), "keys retained after TrimToTop")
+	runtime.KeepAlive(tk)
+}
+
+func TestDecodeReuse(t *testing.T) {
+	words := loadWords()
+	tk := New(100)
+	for _, w := range words {
+		tk.Insert(w, 1)
+	}
+
+	var b bytes.Buffer
+	assert.NoError(t, tk.Encode(&b))
+	data := b.Bytes()
+
+	dst := New(100)
+	for _, w := range words[:500] {
+		dst.Insert(w, 3)
+	}
+	alphas, elts := &dst.alphas[0], &dst.k.elts[:1][0]
+	assert.NoError(t, dst.DecodeReuse(bytes.NewReader(data)))
+	assert.True(t, reflect.DeepEqual(tk, dst), "reused decode differs")
+	assert.True(t, alphas == &dst.alphas[0], "alphas reallocated")
+	assert.True(t, elts == &dst.k.elts[0], "elements reallocated")
+
+	// size mismatch falls back to allocation
+	small := New(5)
+	assert.NoError(t, small.DecodeReuse(bytes.NewReader(data)))
+	assert.True(t, reflect.DeepEqual(tk, small), "fallback decode differs")
+
+	fresh := testing.AllocsPerRun(10, func() {
+		var s Stream
+		_ = s.Decode(bytes.NewReader(data))
+	})
+	reused := testing.AllocsPerRun(10, func() {
+		_ = dst.DecodeReuse(bytes.NewReader(data))
+	})
+	assert.Less(t, reused, fresh)
+}
+
+func TestKeysWithGuarantee(t *testing.T) {
+	tk := New(4)
+	for k, c := range map[string]int{"a": 10, "b": 8, "c": 8, "d": 2} {
+		tk.Insert(k, c)
+	}
+
+	got := tk.KeysWithGuarantee(1)
+	assert.Equal(t, []GuaranteedElement{{Element{Key: "a", Count: 10}, true}}, got)
+
+	// b and c tie, so neither is guaranteed to be in the top 2
+	got = tk.KeysWithGuarantee(2)
+	assert.True(t, got[0].Guaranteed)
+	assert.False(t, got[1].Guaranteed)
+
+	got = tk.KeysWithGuarantee(3)
+	for _, e := range got {
+		assert.True(t, e.Guaranteed, e.Key)
+	}
+
+	// e evicts d, inheriting its count as error
+	tk.Insert("e", 1)
+	got = tk.KeysWithGuarantee(10)
+	assert.Len(t, got, 4)
+	for _, e := range got {
+		assert.Equal(t, e.Key != "e", e.Guaranteed, e.Key)
+	}
+
+	words := loadWords()
+	tk = New(50)
+	exact := make(map[string]int)
+	for _, w := range words {
+		tk.Insert(w, 1)
+		exact[w]++
+	}
+	var counts []int
+	for _, c := range exact {
+		counts = append(counts, c)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(counts)))
+	for _, e := range tk.KeysWithGuarantee(20) {
+		if e.Guaranteed {
+			assert.GreaterOrEqual(t, exact[e.Key], counts[19], e.Key)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tk := New(10)
+	for _, w := range loadWords()[:100] {
+		tk.Insert(w, 1)
+	}
+	var b bytes.Buffer
+	assert.NoError(t, tk.Encode(&b))
+	data := b.Bytes()
+
+	var s Stream
+	for _, n := range []int{0, 1, len(data) / 2, len(data) - 1} {
+		err := s.Decode(bytes.NewReader(data[:n]))
+		assert.ErrorIs(t, err, ErrTruncated, "truncated to %d bytes", n)
+	}
+
+	gb, err := tk.GobEncode()
+	assert.NoError(t, err)
+	gb[0] = 99
+	assert.ErrorIs(t, s.GobDecode(gb), ErrVersion)
+	assert.ErrorIs(t, s.GobDecode(nil), ErrTruncated)
+
+	encode := func(n int, m map[string]int, elts []Element) []byte {
+		var b bytes.Buffer
+		w := msgp.NewWriter(&b)
+		w.WriteInt(n)
+		w.WriteArrayHeader(0)
+		w.WriteMapHeader(uint32(len(m)))
+		for k, v := range m {
+			w.WriteString(k)
+			w.WriteInt(v)
+		}
+		w.WriteArrayHeader(uint32(len(elts)))
+		for _, e := range elts {
+			w.WriteString(e.Key)
+			w.WriteInt(e.Count)
+			w.WriteInt(e.Error)
+		}
+		w.Flush()
+		return b.Bytes()
+	}
+
+	err = s.Decode(bytes.NewReader(encode(-1, nil, nil)))
+	assert.ErrorIs(t, err, ErrInvalidN)
+	err = s.Decode(bytes.NewReader(encode(1, map[string]int{"a": 0, "b": 1}, []Element{{Key: "a"}, {Key: "b"}})))
+	assert.ErrorIs(t, err, ErrInvalidN)
+	err = s.Decode(bytes.NewReader(encode(2, map[string]int{"a": 1, "b": 0}, []Element{{Key: "a"}, {Key: "b"}})))
+	assert.ErrorIs(t, err, ErrInconsistent)
+	assert.NoError(t, s.Decode(bytes.NewReader(encode(2, map[string]int{"a": 0, "b": 1}, []Element{{Key: "a"}, {Key: "b"}}))))
+}
+
+func TestKeysCache(t *testing.T) {
+	// Keys is a pure read by default
+	tk := New(10)
+	tk.Insert("a", 1)
+	tk.Keys()
+	assert.Nil(t, tk.sorted)
+
+	tk = New(10, WithKeysCache())
+	for _, w := range loadWords()[:1000] {
+		tk.Insert(w, 1)
+	}
+
+	keys := tk.Keys()
+	assert.Equal(t, keys, tk.Keys())
+
+	// callers can't corrupt the cache
+	keys[0].Count = -1
+	assert.NotEqual(t, keys, tk.Keys())
+
+	tk.Insert(tk.Keys()[9].Key, 100)
+	assert.Equal(t, 100, tk.Keys()[0].Count-tk.Keys()[0].Error-1)
+
+	tk.Scale(2)
+	for _, e := range tk.Keys() {
+		assert.Equal(t, tk.Estimate(e.Key), e)
+	}
+
+	tk.Clear()
+	assert.Empty(t, tk.Keys())
+}
+
+func BenchmarkKeys(b *testing.B) {
+	for _, opts := range [][]Option{nil, {WithKeysCache()}} {
+		tk := New(1000, opts...)
+		for _, w := range loadWords() {
+			tk.Insert(w, 1)
+		}
+		b.Run(fmt.Sprintf("cache=%v", opts != nil), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				// one insert per hundred polls
+				if i%100 == 0 {
+					tk.Insert("polled", 1)
+				}
+				tk.Keys()
+			}
+		})
+	}
+}
+
+func TestInsertValue(t *testing.T) {
+	tk := New(2, WithoutFilter())
+	tk.InsertValue("a", 1, 100)
+	tk.InsertValue("a", 1, 50)
+	tk.InsertValue("b", 3, 10)
+	tk.Insert("b", 1)
+	assert.Equal(t, []Element{{Key: "b", Count: 4, Value: 10}, {Key: "a", Count: 2, Value: 150}}, tk.Keys())
+	assert.Equal(t, int64(150), tk.Estimate("a").Value)
+
+	// eviction orders by count, and the admitted key starts from its value
+	assert.Equal(t, Element{Key: "c", Count: 3, Error: 2, Value: 7}, tk.InsertValue("c", 1, 7))
+	assert.Zero(t, tk.Estimate("a").Value)
+
+	var buf bytes.Buffer
+	assert.NoError(t, tk.Encode(&buf))
+	decoded := &Stream{}
+	assert.NoError(t, decoded.Decode(&buf))
+	assert.Equal(t, tk.Keys(), decoded.Keys())
+
+	other := New(2, WithoutFilter())
+	other.InsertValue("b", 1, 5)
+	assert.NoError(t, tk.Merge(other))
+	assert.Equal(t, int64(15), tk.Estimate("b").Value)
+
+	js, err := json.Marshal(Element{Key: "x", Count: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"key":"x","count":1,"error":0}`, string(js))
+}
+
+func TestEvictionLog(t *testing.T) {
+	tk := New(1, WithoutFilter(), WithEvictionLog(2))
+	assert.Nil(t, tk.EvictedSince())
+
+	tk.Insert("a", 1)
+	tk.Insert("b", 1)
+	assert.Equal(t, []Element{{Key: "a", Count: 1}}, tk.EvictedSince())
+	assert.Nil(t, tk.EvictedSince())
+
+	// the oldest evictions are overwritten
+	tk.Insert("c", 1)
+	tk.InsertElement(Element{Key: "d", Count: 5})
+	tk.Insert("e", 5)
+	assert.Equal(t, []Element{
+		{Key: "c", Count: 3, Error: 2},
+		{Key: "d", Count: 5},
+	}, tk.EvictedSince())
+
+	tk.Insert("f", 100)
+	tk.Clear()
+	assert.Nil(t, tk.EvictedSince())
+
+	assert.Nil(t, New(1).EvictedSince())
+}
+
+func TestWithCollator(t *testing.T) {
+	insert := func(tk *Stream) {
+		for _, k := range []string{"banana", "apple", "Apple", "Banana", "cherry"} {
+			tk.Insert(k, 1)
+		}
+		tk.Insert("cherry", 1)
+	}
+	keysOf := func(elts []Element) []string {
+		var keys []string
+		for _, e := range elts {
+			keys = append(keys, e.Key)
+		}
+		return keys
+	}
+
+	tk := New(10)
+	insert(tk)
+	assert.Equal(t, []string{"cherry", "Apple", "Banana", "apple", "banana"}, keysOf(tk.Keys()))
+
+	tk = New(10, WithCollator(func(a, b string) bool {
+		return strings.ToLower(a) < strings.ToLower(b)
+	}))
+	insert(tk)
+	want := []string{"cherry", "Apple", "apple", "Banana", "banana"}
+	assert.Equal(t, want, keysOf(tk.Keys()))
+	assert.Equal(t, want[1:], keysOf(tk.KeysMatching(func(k string) bool { return k != "cherry" })))
+
+	var buf bytes.Buffer
+	assert.NoError(t, tk.WriteKeysJSON(&buf, 3))
+	var got []Element
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+	assert.Equal(t, want[:3], keysOf(got))
+}
+
+func TestDecayElapsed(t *testing.T) {
+	counts := []int{1000, 500, 37, 10}
+	build := func(opts ...Option) *Stream {
+		tk := New(10, opts...)
+		for i, c := range counts {
+			tk.Insert(fmt.Sprintf("key-%d", i), c)
+		}
+		return tk
+	}
+
+	once, repeated := build(), build()
+	once.DecayElapsed(0.9, 5)
+	for i := 0; i < 5; i++ {
+		repeated.Scale(0.9)
+	}
+	for i, e := range once.Keys() {
+		exact := float64(counts[i]) * math.Pow(0.9, 5)
+		assert.InDelta(t, exact, float64(e.Count), 0.5, e.Key)
+		assert.InDelta(t, repeated.Keys()[i].Count, e.Count, 2, e.Key)
+	}
+
+	// repeated floors decay faster
+	once, repeated = build(WithRounding(RoundFloor)), build(WithRounding(RoundFloor))
+	once.DecayElapsed(0.9, 5)
+	for i := 0; i < 5; i++ {
+		repeated.Scale(0.9)
+	}
+	assert.Equal(t, 20, repeated.Estimate("key-2").Count)
+	assert.Equal(t, 21, once.Estimate("key-2").Count)
+
+	tk := build()
+	tk.DecayElapsed(0.5, 0)
+	assert.Equal(t, 1000, tk.Keys()[0].Count)
+}
+
+func TestDecodeN(t *testing.T) {
+	for _, n := range []int{1, 7, 100} {
+		tk := New(n)
+		for _, w := range loadWords()[:500] {
+			tk.Insert(w, 1)
+		}
+
+		var buf bytes.Buffer
+		assert.NoError(t, tk.Encode(&buf))
+		decoded := &Stream{}
+		assert.NoError(t, decoded.Decode(&buf))
+		assert.Equal(t, n, decoded.N())
+
+		b, err := tk.GobEncode()
+		assert.NoError(t, err)
+		decoded = &Stream{}
+		assert.NoError(t, decoded.GobDecode(b))
+		assert.Equal(t, n, decoded.N())
+	}
+
+	// n lost but the filter intact, with int or uint32 alphas
+	for _, narrow := range []bool{false, true} {
+		var buf bytes.Buffer
+		w := msgp.NewWriter(&buf)
+		w.WriteInt(0)
+		w.WriteArrayHeader(3)
+		for i := 0; i < 3; i++ {
+			w.WriteInt(1)
+		}
+		w.WriteMapHeader(0)
+		w.WriteArrayHeader(0)
+		if narrow {
+			w.WriteMapHeader(1)
+			w.WriteString("uint32alphas")
+			w.WriteBool(true)
+		}
+		w.Flush()
+		assert.ErrorIs(t, (&Stream{}).Decode(&buf), ErrInvalidN, narrow)
+	}
+}
+
+func TestAdmitProbability(t *testing.T) {
+	words := loadWords()
+	churn := func(opts ...Option) (evictions int, tk *Stream) {
+		tk = New(100, opts...)
+		for _, w := range words {
+			if _, _, evicted := tk.InsertReplace(w, 1); evicted {
+				evictions++
+			}
+		}
+		return evictions, tk
+	}
+
+	base, _ := churn()
+	damped, tk := churn(WithAdmitProbability(0.1, rand.New(rand.NewSource(1))))
+	assert.Less(t, damped, base/2)
+
+	exact := make(map[string]int)
+	for _, w := range words {
+		exact[w]++
+	}
+	for w, c := range exact {
+		assert.GreaterOrEqual(t, tk.Estimate(w).Count, c, w)
+	}
+
+	// seeded streams are reproducible
+	again, tk2 := churn(WithAdmitProbability(0.1, rand.New(rand.NewSource(1))))
+	assert.Equal(t, damped, again)
+	assert.Equal(t, tk.Keys(), tk2.Keys())
+
+	// without a filter every key is admitted, so none is underestimated
+	tk = New(2, WithoutFilter(), WithAdmitProbability(0.01, rand.New(rand.NewSource(1))))
+	tk.Insert("a", 5)
+	tk.Insert("b", 5)
+	for i := 0; i < 50; i++ {
+		tk.Insert("x", 1)
+	}
+	assert.GreaterOrEqual(t, tk.Estimate("x").Count, 50)
+}
+
+func TestProto(t *testing.T) {
+	m := &topkpb.TopK{N: 2, Elements: []topkpb.Element{{Key: "a", Count: 3, Error: 1}}}
+	b := m.Marshal()
+	assert.Equal(t, []byte{0x08, 0x02, 0x12, 0x07, 0x0a, 0x01, 'a', 0x10, 0x03, 0x18, 0x01}, b)
+
+	// unknown fields are skipped
+	b = append(b, 0x20, 0x05, 0x2a, 0x01, 'x')
+	var got topkpb.TopK
+	assert.NoError(t, got.Unmarshal(b))
+	assert.Equal(t, *m, got)
+	assert.Error(t, got.Unmarshal(b[:5]))
+
+	tk := New(50)
+	for _, w := range loadWords() {
+		tk.Insert(w, 1)
+	}
+	assert.NoError(t, got.Unmarshal(tk.ToProto().Marshal()))
+	decoded, err := FromProto(&got)
+	assert.NoError(t, err)
+	assert.Equal(t, tk.N(), decoded.N())
+	assert.Equal(t, tk.Keys(), decoded.Keys())
+
+	for _, m := range []*topkpb.TopK{
+		{N: -1},
+		{N: 0},
+		{N: 1 << 62},
+		{N: 1, Elements: []topkpb.Element{{Key: "a"}, {Key: "b"}}},
+	} {
+		_, err = FromProto(m)
+		assert.ErrorIs(t, err, ErrInvalidN, m.N)
+	}
+}
+
+func TestMergeWithStats(t *testing.T) {
+	a, b := New(2), New(2)
+	a.Insert("x", 5)
+	a.Insert("y", 3)
+	b.Insert("x", 2)
+	b.Insert("z", 1)
+
+	st, err := a.MergeWithStats(b)
+	assert.NoError(t, err)
+	assert.Equal(t, MergeStats{Dropped: 1}, st)
+	assert.Equal(t, []Element{{Key: "x", Count: 7}, {Key: "y", Count: 3}}, a.Keys())
+
+	// keys monitored by one side pick up the other's filter count
+	b = New(2)
+	b.Insert("x", 4)
+	b.Insert("w", 4)
+	b.Insert("v", 6)
+	st, err = a.MergeWithStats(b)
+	assert.NoError(t, err)
+	var want int64
+	for _, e := range a.Keys() {
+		want += int64(e.Error)
+	}
+	assert.Equal(t, want, st.AddedError)
+	assert.Positive(t, st.Dropped)
+
+	_, err = a.MergeWithStats(New(3))
+	assert.Error(t, err)
+}
+
+func TestKeyNormalizer(t *testing.T) {
+	var calls int
+	lower := func(x string) string {
+		calls++
+		return strings.ToLower(x)
+	}
+	tk := New(10, WithKeyNormalizer(lower), WithExactCounts(), WithMode(Signed))
+
+	for _, h := range []string{"Example.com", "EXAMPLE.COM", "example.com", "Other.org"} {
+		calls = 0
+		tk.Insert(h, 1)
+		assert.Equal(t, 1, calls, h)
+	}
+	assert.Equal(t, []Element{{Key: "example.com", Count: 3}, {Key: "other.org", Count: 1}}, tk.Keys())
+
+	calls = 0
+	assert.Equal(t, 3, tk.Estimate("ExAmPlE.com").Count)
+	assert.Equal(t, 3, tk.EstimateBytes([]byte("EXAMPLE.com")).Count)
+	e, err := tk.Update("OTHER.ORG", -1)
+	assert.NoError(t, err)
+	assert.Equal(t, Element{Key: "other.org"}, e)
+	tk.Set("Third.NET", 5)
+	assert.Equal(t, 4, calls)
+
+	c, _ := tk.ExactCount("Example.COM")
+	assert.Equal(t, 3, c)
+	assert.Equal(t, 5, tk.Estimate("third.net").Count)
+
+	tk = FromElements(10, []Element{{Key: "A", Count: 1}, {Key: "a", Count: 2}}, WithKeyNormalizer(strings.ToLower))
+	assert.Equal(t, []Element{{Key: "a", Count: 3}}, tk.Keys())
+}
+
+func TestWriteRecords(t *testing.T) {
+	tk := New(100)
+	for _, w := range loadWords() {
+		tk.Insert(w, 1)
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, tk.WriteRecords(&buf, 10))
+	data := buf.Bytes()
+
+	var got []Element
+	assert.NoError(t, ReadRecords(bytes.NewReader(data), func(e Element) error {
+		got = append(got, e)
+		return nil
+	}))
+	assert.Equal(t, tk.Keys()[:10], got)
+
+	// records are self-contained
+	sz := binary.BigEndian.Uint32(data)
+	var first Element
+	assert.NoError(t, ReadRecords(bytes.NewReader(data[:4+sz]), func(e Element) error {
+		first = e
+		return nil
+	}))
+	assert.Equal(t, got[0], first)
+
+	err := ReadRecords(bytes.NewReader(data[:len(data)-1]), func(Element) error { return nil })
+	assert.ErrorIs(t, err, ErrTruncated)
+
+	stop := errors.New("stop")
+	assert.Equal(t, stop, ReadRecords(bytes.NewReader(data), func(Element) error { return stop }))
+
+	buf.Reset()
+	assert.NoError(t, tk.WriteRecords(&buf, -1))
+	assert.Zero(t, buf.Len())
+}
+
+func TestKeyCopy(t *testing.T) {
+	var collected int32
+	insertView := func(tk *Stream) {
+		buf := make([]byte, 1<<20)
+		copy(buf, "key")
+		runtime.SetFinalizer(&buf[0], func(*byte) {
+			atomic.StoreInt32(&collected, 1)
+		})
+		tk.Insert(unsafe.String(&buf[0], 3), 1)
+	}
+	retained := func() bool {
+		for i := 0; i < 10 && atomic.LoadInt32(&collected) == 0; i++ {
+			runtime.GC()
+			time.Sleep(time.Millisecond)
+		}
+		return atomic.LoadInt32(&collected) == 0
+	}
+
+	tk := New(10)
+	insertView(tk)
+	assert.False(t, retained(), "buffer retained by copied key")
+	assert.Equal(t, 1, tk.Estimate("key").Count)
+	runtime.KeepAlive(tk)
+
+	atomic.StoreInt32(&collected, 0)
+	tk = New(10, WithoutKeyCopy())
+	insertView(tk)
+	assert.True(t, retained(), "buffer released despite shared key")
+	runtime.KeepAlive(tk)
+}
+
+func TestExactAbove(t *testing.T) {
+	tk := New(2, WithExactAbove(10, 2))
+	tk.Insert("a", 9)
+	tk.Insert("b", 1)
+	assert.Empty(t, tk.promoted)
+
+	// a crosses the threshold and leaves the heap
+	assert.Equal(t, Element{Key: "a", Count: 10}, tk.Insert("a", 1))
+	assert.Contains(t, tk.promoted, "a")
+	assert.Equal(t, 1, tk.k.Len())
+
+	// churn in the heap never evicts a
+	for i := 0; i < 100; i++ {
+		tk.Insert(fmt.Sprintf("tail-%d", i), 1)
+	}
+	tk.Insert("a", 5)
+	assert.Equal(t, Element{Key: "a", Count: 15}, tk.Estimate("a"))
+	keys := tk.Keys()
+	assert.Len(t, keys, 3)
+	assert.Equal(t, Element{Key: "a", Count: 15}, keys[0])
+	assert.Equal(t, int64(15+1+100), tk.Stats().Total)
+
+	// the cap keeps further keys approximate
+	tk.Insert("c", 20)
+	tk.Insert("d", 20)
+	assert.Len(t, tk.promoted, 2)
+	assert.Equal(t, 2, tk.k.Len())
+	_, inHeap := tk.k.m["d"]
+	assert.True(t, inHeap)
+
+	var buf bytes.Buffer
+	assert.NoError(t, tk.Encode(&buf))
+	decoded := New(2, WithExactAbove(10, 2))
+	assert.NoError(t, decoded.Decode(&buf))
+	assert.Equal(t, tk.promoted, decoded.promoted)
+	assert.Equal(t, tk.Keys(), decoded.Keys())
+
+	// merging moves heap elements of promoted keys into the promoted ones
+	other := New(2)
+	other.Insert("a", 3)
+	other.Insert("e", 1)
+	assert.NoError(t, tk.Merge(other))
+	assert.Equal(t, 18, tk.Estimate("a").Count)
+	_, inHeap = tk.k.m["a"]
+	assert.False(t, inHeap)
+	assert.NoError(t, tk.WalkHeap(nil))
+
+	tk.Clear()
+	assert.Empty(t, tk.Keys())
+}
+
+func TestSetAlphaFloor(t *testing.T) {
+	tk := New(2)
+	tk.Insert("a", 10)
+	tk.Insert("b", 5)
+
+	// without a floor a new key needs the minimum count to be admitted
+	assert.Equal(t, Element{Key: "c", Count: 1}, tk.Insert("c", 1))
+	assert.Equal(t, []string{"a", "b"}, []string{tk.Keys()[0].Key, tk.Keys()[1].Key})
+
+	tk.SetAlphaFloor(4)
+	for i := 0; i < tk.alphaLen(); i++ {
+		assert.GreaterOrEqual(t, tk.alphaAt(i), 4)
+	}
+
+	// now a count of 1 suffices, and the key is admitted with the floor as error
+	e := tk.Insert("d", 1)
+	assert.Equal(t, 1, e.Count-e.Error)
+	assert.GreaterOrEqual(t, e.Error, 4)
+	_, ok := tk.k.m["d"]
+	assert.True(t, ok)
+
+	nofilter := New(2, WithoutFilter())
+	nofilter.SetAlphaFloor(4)
+	assert.Nil(t, nofilter.alphas)
+}
+
+func TestKeysByName(t *testing.T) {
+	tk := New(10)
+	for k, c := range map[string]int{"b": 5, "a": 1, "c": 3} {
+		tk.Insert(k, c)
+	}
+	assert.Equal(t, []Element{{Key: "a", Count: 1}, {Key: "b", Count: 5}, {Key: "c", Count: 3}}, tk.KeysByName())
+	assert.Nil(t, New(10).KeysByName())
+}
+
+func TestEstimateTouch(t *testing.T) {
+	build := func() *Stream {
+		tk := New(2, WithRecencyEviction(), WithoutFilter())
+		tk.Insert("a", 1)
+		tk.Insert("b", 1)
+		return tk
+	}
+
+	// querying is a pure read, so the least recently updated key goes
+	tk := build()
+	assert.Equal(t, 1, tk.Estimate("a").Count)
+	_, evicted, _ := tk.InsertReplace("c", 1)
+	assert.Equal(t, "a", evicted.Key)
+
+	// touching keeps a
+	tk = build()
+	assert.Equal(t, 1, tk.EstimateTouch("a").Count)
+	_, evicted, _ = tk.InsertReplace("c", 1)
+	assert.Equal(t, "b", evicted.Key)
+
+	assert.Equal(t, Element{Key: "x", Count: 1, Error: 1}, tk.EstimateTouch("x"))
+}
+
+func TestInsertMap(t *testing.T) {
+	counts := make(map[string]int)
+	for _, w := range loadWords() {
+		counts[w]++
+	}
+
+	var first []Element
+	for i := 0; i < 5; i++ {
+		tk := New(50)
+		tk.Insert("existing key", 1000)
+		tk.InsertMap(counts)
+		if i == 0 {
+			first = tk.Keys()
+			continue
+		}
+		assert.Equal(t, first, tk.Keys(), "run %d", i)
+	}
+	assert.Equal(t, Element{Key: "existing key", Count: 1000}, first[0])
+	for _, e := range first[1:] {
+		assert.GreaterOrEqual(t, e.Count, counts[e.Key], e.Key)
+	}
+}
+
+func TestCurrentSum(t *testing.T) {
+	tk := New(10)
+	for i, c := range []int{40, 30, 20, 10} {
+		tk.Insert(fmt.Sprintf("key-%d", i), c)
+	}
+	assert.Equal(t, int64(100), tk.CurrentSum())
+
+	tk.Scale(0.5)
+	assert.Equal(t, int64(50), tk.CurrentSum())
+	assert.Equal(t, int64(100), tk.Stats().Total)
+
+	tk.Clear()
+	assert.Zero(t, tk.CurrentSum())
+}
+
+func TestZeroStream(t *testing.T) {
+	var tk Stream
+	assert.Equal(t, Element{Key: "a", Count: 1}, tk.Insert("a", 1))
+	assert.Equal(t, Element{Key: "a"}, tk.Estimate("a"))
+	assert.Equal(t, Element{Key: "b", Count: 2}, tk.InsertElement(Element{Key: "b", Count: 2}))
+	tk.Set("c", 3)
+	assert.Empty(t, tk.Keys())
+	assert.Equal(t, int64(6), tk.Stats().Total)
+
+	var buf bytes.Buffer
+	assert.NoError(t, tk.Encode(&buf))
+	assert.NoError(t, tk.Decode(&buf))
+	assert.NoError(t, tk.Merge(&Stream{}))
+}
+
+func TestCoverage(t *testing.T) {
+	assert.Zero(t, New(2).Coverage())
+
+	tk := New(2, WithoutFilter())
+	tk.Insert("a", 6)
+	tk.Insert("b", 2)
+	assert.Equal(t, 1.0, tk.Coverage())
+
+	tk = New(2)
+	tk.Insert("a", 6)
+	tk.Insert("b", 2)
+	tk.Insert("c", 1)
+	tk.Insert("d", 1)
+	assert.InDelta(t, 0.8, tk.Coverage(), 1e-9)
+}
+
+func TestSortedStorage(t *testing.T) {
+	words := loadWords()
+	// without recency, the heap and sorted storage may evict different
+	// elements among full ties, so only compare results without evictions
+	for _, tc := range []struct {
+		n    int
+		opts []Option
+	}{
+		{20000, nil},
+		{100, []Option{WithRecencyEviction()}},
+		{100, []Option{WithRecencyEviction(), WithoutFilter()}},
+	} {
+		opts := tc.opts
+		heapMode := New(tc.n, opts...)
+		sorted := New(tc.n, append(opts, WithSortedStorage())...)
+		for _, w := range words[:20000] {
+			assert.Equal(t, heapMode.Insert(w, 1), sorted.Insert(w, 1))
+		}
+		assert.True(t, sort.IsSorted(&sorted.k))
+		assert.NoError(t, sorted.WalkHeap(nil))
+		assert.Equal(t, heapMode.Keys(), sorted.Keys())
+		for _, w := range words[:1000] {
+			assert.Equal(t, heapMode.Estimate(w), sorted.Estimate(w))
+		}
+
+		sorted.TrimToTop(50)
+		sorted.Scale(0.5)
+		assert.True(t, sort.IsSorted(&sorted.k))
+	}
+
+	// evictions still respect the bounds
+	sorted := New(100, WithSortedStorage())
+	exact := make(map[string]int)
+	for _, w := range words {
+		e := sorted.Insert(w, 1)
+		exact[w]++
+		assert.GreaterOrEqual(t, e.Count, exact[w])
+		assert.LessOrEqual(t, e.Count-e.Error, exact[w])
+	}
+	assert.True(t, sort.IsSorted(&sorted.k))
+
+	heapMode := New(100)
+	for _, w := range words {
+		heapMode.Insert(w, 1)
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, heapMode.Encode(&buf))
+	decoded := New(100, WithSortedStorage())
+	assert.NoError(t, decoded.Decode(&buf))
+	assert.True(t, sort.IsSorted(&decoded.k))
+	assert.Equal(t, heapMode.Keys(), decoded.Keys())
+}
+
+func BenchmarkKeysSorted(b *testing.B) {
+	for _, opts := range [][]Option{nil, {WithSortedStorage()}} {
+		tk := New(1000, opts...)
+		for _, w := range loadWords() {
+			tk.Insert(w, 1)
+		}
+		b.Run(fmt.Sprintf("sorted=%v", opts != nil), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				tk.Keys()
+			}
+		})
+	}
+}
+
+func TestEncodeTop(t *testing.T) {
+	words := loadWords()
+	tk := New(100)
+	exact := make(map[string]int)
+	for _, w := range words {
+		tk.Insert(w, 1)
+		exact[w]++
+	}
+	keys := tk.Keys()
+
+	var full, top bytes.Buffer
+	assert.NoError(t, tk.Encode(&full))
+	assert.NoError(t, tk.EncodeTop(&top, 10))
+	assert.Less(t, top.Len(), full.Len())
+	assert.Equal(t, keys, tk.Keys())
+
+	decoded := &Stream{}
+	assert.NoError(t, decoded.Decode(&top))
+	assert.Equal(t, 100, decoded.N())
+	assert.Equal(t, keys[:10], decoded.Keys())
+	for w, c := range exact {
+		assert.GreaterOrEqual(t, decoded.Estimate(w).Count, c, w)
+	}
+
+	top.Reset()
+	assert.NoError(t, tk.EncodeTop(&top, 1000))
+	assert.NoError(t, decoded.Decode(&top))
+	assert.Equal(t, keys, decoded.Keys())
+}
+
+func TestHits(t *testing.T) {
+	tk := New(3, WithHits())
+	tk.Insert("volume", 1000)
+	for i := 0; i < 50; i++ {
+		tk.Insert("frequent", 1)
+	}
+	tk.InsertValue("frequent", 1, 10)
+
+	assert.Equal(t, []Element{
+		{Key: "volume", Count: 1000, Hits: 1},
+		{Key: "frequent", Count: 51, Value: 10, Hits: 51},
+	}, tk.Keys())
+
+	var buf bytes.Buffer
+	assert.NoError(t, tk.Encode(&buf))
+	decoded := &Stream{}
+	assert.NoError(t, decoded.Decode(&buf))
+	assert.Equal(t, tk.Keys(), decoded.Keys())
+
+	other := New(3, WithHits())
+	other.Insert("frequent", 1)
+	assert.NoError(t, tk.Merge(other))
+	assert.Equal(t, int64(52), tk.Estimate("frequent").Hits)
+
+	assert.Zero(t, New(3).Insert("x", 1).Hits)
+}
+
+func TestMergeDecode(t *testing.T) {
+	fill := func(s *Stream, offset, base int) *Stream {
+		for i := 0; i < 8; i++ {
+			s.Insert(fmt.Sprintf("k%d", i+offset), base+i)
+		}
+		return s
+	}
+	b := fill(New(10), 4, 100)
+
+	var buf bytes.Buffer
+	assert.NoError(t, b.Encode(&buf))
+	encoded := buf.Bytes()
+
+	want := fill(New(10), 0, 10)
+	assert.NoError(t, want.Merge(b))
+
+	got := fill(New(10), 0, 10)
+	assert.NoError(t, got.MergeDecode(bytes.NewReader(encoded)))
+	assert.Equal(t, want.Keys(), got.Keys())
+	assert.Equal(t, want.Estimate("unseen"), got.Estimate("unseen"))
+
+	assert.True(t, errors.Is(got.MergeDecode(bytes.NewReader(encoded[:len(encoded)/2])), ErrTruncated))
+	assert.Equal(t, want.Keys(), got.Keys())
+
+	assert.Error(t, New(5).MergeDecode(bytes.NewReader(encoded)))
+}
+
+func TestMaxCount(t *testing.T) {
+	tk := New(3, WithMaxCount(100))
+	tk.Insert("runaway", 1000)
+	tk.Insert("other runaway", 500)
+	tk.Insert("small", 10)
+	tk.Insert("small", 10)
+
+	assert.Equal(t, 100, tk.Estimate("runaway").Count)
+	assert.Equal(t, 100, tk.Estimate("other runaway").Count)
+	assert.Equal(t, 20, tk.Estimate("small").Count)
+
+	// a key whose filter count exceeds the maximum is clamped on admission
+	for i := 0; i < 20; i++ {
+		tk.Insert("runaway", 1000)
+		tk.Insert("other runaway", 1000)
+		tk.Insert(fmt.Sprintf("new%d", i), 90)
+	}
+	for _, e := range tk.Keys() {
+		assert.LessOrEqual(t, e.Count, 100)
+		assert.LessOrEqual(t, e.Error, e.Count)
+	}
+	for i := 1; i < len(tk.k.elts); i++ {
+		assert.False(t, tk.k.Less(i, (i-1)/2), "heap violated at %d", i)
+	}
+
+	// Set and InsertElement clamp as well
+	for _, opts := range [][]Option{nil, {WithStore(NewHeapStore(3))}} {
+		tk = New(3, append(opts, WithMaxCount(100))...)
+		assert.Equal(t, 100, tk.Set("k", 1000).Count)
+		assert.Equal(t, 100, tk.Set("k", 2000).Count)
+		assert.Equal(t, 100, tk.InsertElement(Element{Key: "j", Count: 5000}).Count)
+		assert.Equal(t, 100, tk.InsertElement(Element{Key: "j", Count: 5000}).Count)
+		for _, e := range tk.Keys() {
+			assert.LessOrEqual(t, e.Count, 100)
+		}
+	}
+}
+
+func TestInsertClassified(t *testing.T) {
+	tk := New(2)
+
+	_, a := tk.InsertClassified("a", 10)
+	assert.Equal(t, Admitted, a)
+	_, a = tk.InsertClassified("a", 1)
+	assert.Equal(t, Tracked, a)
+	_, a = tk.InsertClassified("b", 5)
+	assert.Equal(t, Admitted, a)
+
+	e, a := tk.InsertClassified("c", 1)
+	assert.Equal(t, Filtered, a)
+	assert.Equal(t, Element{Key: "c", Count: 1}, e)
+
+	e, a = tk.InsertClassified("d", 100)
+	assert.Equal(t, Replaced, a)
+	assert.Equal(t, Element{Key: "d", Count: 100}, e)
+	assert.Equal(t, []Element{{Key: "d", Count: 100}, {Key: "a", Count: 11}}, tk.Keys())
+}
+
+func TestDecodeAllGob(t *testing.T) {
+	var log bytes.Buffer
+	for i := 1; i <= 3; i++ {
+		tk := New(5)
+		tk.Insert("a", i)
+		assert.NoError(t, gob.NewEncoder(&log).Encode(tk))
+	}
+
+	streams, err := DecodeAllGob(bytes.NewReader(log.Bytes()))
+	assert.NoError(t, err)
+	if assert.Len(t, streams, 3) {
+		for i, s := range streams {
+			assert.Equal(t, []Element{{Key: "a", Count: i + 1}}, s.Keys())
+		}
+	}
+
+	streams, err = DecodeAllGob(bytes.NewReader(log.Bytes()[:log.Len()-3]))
+	assert.True(t, errors.Is(err, ErrTruncated), "got %v", err)
+	assert.Len(t, streams, 2)
+
+	streams, err = DecodeAllGob(&bytes.Buffer{})
+	assert.NoError(t, err)
+	assert.Empty(t, streams)
+}
+
+func TestInclusionThreshold(t *testing.T) {
+	tk := New(10)
+	assert.Equal(t, 0, tk.InclusionThreshold())
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		tk.Insert(fmt.Sprintf("k%d", r.Intn(500)), 1)
+	}
+	threshold := tk.InclusionThreshold()
+	assert.GreaterOrEqual(t, threshold, tk.k.elts[0].Count)
+
+	// a new key counted above the threshold is monitored however it arrives
+	for i := 0; i <= threshold; i++ {
+		tk.Insert("newcomer", 1)
+		tk.Insert(fmt.Sprintf("k%d", r.Intn(500)), 1)
+	}
+	_, ok := tk.k.m["newcomer"]
+	assert.True(t, ok)
+}
+
+func TestKeyArena(t *testing.T) {
+	tk := New(4, WithKeyArena(8))
+	for _, k := range []string{"ab", "abc", "", "a key longer than a chunk"} {
+		tk.Insert(k, 1)
+		_, ok := tk.k.m[k]
+		assert.True(t, ok, k)
+	}
+
+	// consecutive keys are stored next to each other in one chunk
+	ab, abc := tk.k.elts[tk.k.m["ab"]].Key, tk.k.elts[tk.k.m["abc"]].Key
+	assert.True(t, unsafe.StringData(abc) == (*byte)(unsafe.Add(unsafe.Pointer(unsafe.StringData(ab)), 2)))
+
+	// keys admitted after Clear go into a new chunk, leaving old keys intact
+	tk.Clear()
+	assert.Equal(t, 8, tk.arena.size)
+	tk.Insert("xy", 1)
+	assert.Equal(t, "xy", tk.Keys()[0].Key)
+	assert.Equal(t, "abc", abc)
+}
+
+func BenchmarkInsertChurn(b *testing.B) {
+	words := make([]string, 1<<16)
+	for i := range words {
+		words[i] = fmt.Sprintf("word-%d", i)
+	}
+
+	for _, arena := range []int{0, 4096} {
+		b.Run(fmt.Sprintf("arena=%d", arena), func(b *testing.B) {
+			tk := New(10000, WithoutFilter(), WithKeyArena(arena))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				tk.Insert(words[i&(len(words)-1)], 1)
+			}
+		})
+	}
+}
+
+func TestQuery(t *testing.T) {
+	tk := New(3)
+	tk.Insert("a", 100)
+	tk.Insert("b", 50)
+	tk.Insert("c", 10)
+	tk.Insert("d", 20) // replaces c
+
+	assert.Equal(t, QueryResult{Key: "a", Count: 100, Lower: 100, Monitored: true, Guaranteed: true, Rank: 0}, tk.Query("a"))
+	assert.Equal(t, QueryResult{Key: "b", Count: 50, Lower: 50, Monitored: true, Guaranteed: true, Rank: 1}, tk.Query("b"))
+
+	// the last element is bounded by the filter, which holds the count of c
+	assert.Equal(t, QueryResult{Key: "d", Count: 20, Lower: 20, Monitored: true, Guaranteed: true, Rank: 2}, tk.Query("d"))
+
+	c := tk.Query("c")
+	assert.Equal(t, QueryResult{Key: "c", Count: 10, Error: 10, Rank: -1}, c)
+
+	// consistent with Keys and KeysWithGuarantee
+	for i, g := range tk.KeysWithGuarantee(3) {
+		q := tk.Query(g.Key)
+		assert.Equal(t, i, q.Rank)
+		assert.Equal(t, g.Guaranteed, q.Guaranteed)
+	}
+
+	// ties are not guaranteed
+	tk = New(3)
+	tk.Insert("x", 5)
+	tk.Insert("y", 5)
+	assert.Equal(t, QueryResult{Key: "x", Count: 5, Lower: 5, Monitored: true, Rank: 0}, tk.Query("x"))
+	assert.Equal(t, 1, tk.Query("y").Rank)
+}
+
+// recordingListener records the calls of a Listener as strings
+type recordingListener struct{ calls []string }
+
+func (l *recordingListener) OnAdmit(e Element, count int) {
+	l.calls = append(l.calls, fmt.Sprintf("admit %s %d/%d", e.Key, e.Count, count))
+}
+
+func (l *recordingListener) OnEvict(e Element) {
+	l.calls = append(l.calls, fmt.Sprintf("evict %s %d", e.Key, e.Count))
+}
+
+func (l *recordingListener) OnFilter(e Element, count int) {
+	l.calls = append(l.calls, fmt.Sprintf("filter %s %d/%d", e.Key, e.Count, count))
+}
+
+func (l *recordingListener) OnUpdate(e Element, count int) {
+	l.calls = append(l.calls, fmt.Sprintf("update %s %d/%d", e.Key, e.Count, count))
+}
+
+func TestListener(t *testing.T) {
+	l := &recordingListener{}
+	tk := New(2, WithListener(l))
+	tk.Insert("a", 10)
+	tk.Insert("a", 1)
+	tk.Insert("b", 5)
+	tk.Insert("c", 1)
+	tk.Insert("d", 100)
+	assert.Equal(t, []string{
+		"admit a 10/10",
+		"update a 11/1",
+		"admit b 5/5",
+		"filter c 1/1",
+		"evict b 5",
+		"admit d 100/100",
+	}, l.calls)
+
+	// Set and negative updates of monitored keys are reported as updates
+	l = &recordingListener{}
+	tk = New(2, WithListener(l), WithMode(Signed), WithExactAbove(50, 1))
+	tk.Insert("a", 10)
+	tk.Insert("p", 60)
+	tk.Set("a", 4)
+	tk.Set("p", 70)
+	tk.Set("b", 3)
+	_, err := tk.Update("a", -2)
+	assert.NoError(t, err)
+	_, err = tk.Update("p", -5)
+	assert.NoError(t, err)
+	_, err = tk.Update("unseen", -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"admit a 10/10",
+		"admit p 60/60",
+		"update a 4/-6",
+		"update p 70/10",
+		"admit b 3/3",
+		"update a 2/-2",
+		"update p 65/-5",
+	}, l.calls)
+
+	// the locked stream notifies after releasing its lock
+	var ls *LockedStream
+	reader := &readingListener{read: func() { ls.Keys() }}
+	ls = NewLocked(2, WithListener(reader))
+	ls.Insert("a", 1)
+	assert.Equal(t, 1, reader.n)
+}
+
+// readingListener reads the stream on every admission
+type readingListener struct {
+	recordingListener
+	read func()
+	n    int
+}
+
+func (l *readingListener) OnAdmit(e Element, count int) {
+	l.read()
+	l.n++
+}
+
+func TestEstimateN(t *testing.T) {
+	assert.Equal(t, 0, EstimateN(0, 1.5))
+	assert.Equal(t, 100, EstimateN(10, 1))
+	assert.Equal(t, 100, EstimateN(10, 0.5))
+	assert.Equal(t, 10, EstimateN(10, 100))
+
+	// (100/2)^(1/2) * 100
+	assert.Equal(t, 708, EstimateN(100, 2))
+
+	// more skew needs fewer counters
+	assert.Less(t, EstimateN(1000, 2), EstimateN(1000, 1.2))
+	assert.Equal(t, math.MaxInt32, EstimateN(1<<20, 1))
+
+	// the suggested n captures the true top k of a Zipfian stream
+	r := rand.New(rand.NewSource(0))
+	zipf := rand.NewZipf(r, 1.5, 1, 1000000)
+	const k = 20
+	tk := New(EstimateN(k, 1.5))
+	for i := 0; i < 200000; i++ {
+		tk.Insert(strconv.FormatUint(zipf.Uint64(), 10), 1)
+	}
+	for i, e := range tk.Keys()[:k] {
+		assert.Equal(t, strconv.Itoa(i), e.Key)
+	}
+}
+
+func TestMergeExact(t *testing.T) {
+	window := func() *Stream {
+		w := New(3, WithoutFilter())
+		w.Insert("a", 10)
+		w.Insert("b", 5)
+		w.Insert("c", 2)
+		return w
+	}
+	aggregate := func() *Stream {
+		agg := New(3, WithoutFilter())
+		agg.Insert("a", 100)
+		agg.Insert("x", 50)
+		return agg
+	}
+
+	// Merge takes the minimum of the full window as the error of its keys
+	agg := aggregate()
+	assert.NoError(t, agg.Merge(window()))
+	assert.Equal(t, Element{Key: "x", Count: 52, Error: 2}, agg.Estimate("x"))
+
+	agg = aggregate()
+	assert.NoError(t, agg.MergeExact(window()))
+	assert.Equal(t, []Element{
+		{Key: "a", Count: 110},
+		{Key: "x", Count: 50},
+		{Key: "b", Count: 5},
+	}, agg.Keys())
+
+	assert.Error(t, agg.MergeExact(New(5)))
+}
+
+// mapStore is a Store scanning a map for the minimum
+type mapStore map[string]Element
+
+func (m mapStore) Len() int { return len(m) }
+
+func (m mapStore) Get(key string) (Element, bool) {
+	e, ok := m[key]
+	return e, ok
+}
+
+func (m mapStore) Set(e Element) { m[e.Key] = e }
+
+func (m mapStore) Min() (Element, bool) {
+	var min Element
+	var found bool
+	for _, e := range m {
+		if !found || e.Count < min.Count || e.Count == min.Count && (e.Error > min.Error || e.Error == min.Error && e.Key < min.Key) {
+			min, found = e, true
+		}
+	}
+	return min, found
+}
+
+func (m mapStore) Replace(e Element) Element {
+	min, _ := m.Min()
+	delete(m, min.Key)
+	m[e.Key] = e
+	return min
+}
+
+func (m mapStore) Each(fn func(e Element) bool) {
+	for _, e := range m {
+		if !fn(e) {
+			return
+		}
+	}
+}
+
+func (m mapStore) Delete(key string) { delete(m, key) }
+
+func TestStore(t *testing.T) {
+	words := loadWords()[:20000]
+
+	tk := New(100)
+	heap := New(100, WithStore(NewHeapStore(100)))
+	for _, w := range words {
+		assert.Equal(t, tk.Insert(w, 1), heap.Insert(w, 1))
+	}
+	assert.Equal(t, tk.Keys(), heap.Keys())
+	assert.Equal(t, tk.Estimate("the"), heap.Estimate("the"))
+	assert.Equal(t, tk.Estimate("unseen"), heap.Estimate("unseen"))
+	assert.Empty(t, heap.k.elts)
+
+	// any store keeping the contract counts the same top keys
+	r := rand.New(rand.NewSource(0))
+	zipf := rand.NewZipf(r, 1.5, 1, 100000)
+	store := mapStore{}
+	tk, custom := New(100), New(100, WithStore(store))
+	for i := 0; i < 20000; i++ {
+		w := strconv.FormatUint(zipf.Uint64(), 10)
+		tk.Insert(w, 1)
+		custom.Insert(w, 1)
+	}
+	assert.Len(t, store, 100)
+	assert.Equal(t, tk.Keys()[:10], custom.Keys()[:10])
+}
+
+func TestStoreMethods(t *testing.T) {
+	words := loadWords()[:5000]
+	for _, opts := range [][]Option{
+		{WithMode(Signed)},
+		{WithMode(Signed), WithoutFilter()},
+		{WithMode(Signed), WithExactAbove(30, 3), WithEpochs()},
+	} {
+		tk := New(50, opts...)
+		stored := New(50, append(opts, WithStore(NewHeapStore(50)))...)
+		same := func() {
+			t.Helper()
+			assert.Equal(t, tk.Keys(), stored.Keys())
+			assert.Equal(t, tk.Stats(), stored.Stats())
+			assert.Empty(t, stored.k.elts)
+			assert.NoError(t, stored.Validate())
+		}
+		for _, w := range words {
+			tk.Insert(w, 1)
+			stored.Insert(w, 1)
+		}
+		same()
+		assert.Equal(t, len(tk.promoted), len(stored.promoted))
+
+		// reads see the elements of the store
+		top := tk.Keys()[0].Key
+		assert.Equal(t, tk.Query(top), stored.Query(top))
+		assert.True(t, stored.Query(top).Monitored)
+		assert.Equal(t, tk.EstimateBytes([]byte(top)), stored.EstimateBytes([]byte(top)))
+		e, monitored, alpha := stored.EstimateDebug(top)
+		we, wmonitored, walpha := tk.EstimateDebug(top)
+		assert.Equal(t, we, e)
+		assert.Equal(t, wmonitored, monitored)
+		assert.Equal(t, walpha, alpha)
+		min, ok := stored.PeekMin()
+		assert.True(t, ok)
+		assert.Equal(t, tk.k.elts[0].Count, min.Count)
+		assert.Equal(t, tk.InclusionThreshold(), stored.InclusionThreshold())
+		assert.True(t, stored.IsFull())
+		_, ok = stored.Sample(rand.New(rand.NewSource(0)))
+		assert.True(t, ok)
+
+		// updates go through the store
+		assert.Equal(t, tk.Set(top, 100), stored.Set(top, 100))
+		assert.Equal(t, Element{Key: top, Count: 100}, stored.Estimate(top))
+		e, err := stored.Update(top, -10)
+		assert.NoError(t, err)
+		assert.Equal(t, 90, e.Count)
+		_, _ = tk.Update(top, -10)
+		assert.Equal(t, tk.InsertElement(Element{Key: "x", Count: 500, Error: 2}), stored.InsertElement(Element{Key: "x", Count: 500, Error: 2}))
+		stored.NewEpoch()
+		tk.NewEpoch()
+		tk.Insert("y", 40)
+		stored.Insert("y", 40)
+		assert.Equal(t, tk.KeysSince(1), stored.KeysSince(1))
+		if tk.k.epochs {
+			assert.NotEmpty(t, stored.KeysSince(1))
+		}
+		same()
+
+		tk.Scale(0.5)
+		stored.Scale(0.5)
+		same()
+		tk.TrimToTop(20)
+		stored.TrimToTop(20)
+		same()
+
+		// encoding and merging see the elements of the store
+		var want, got bytes.Buffer
+		assert.NoError(t, tk.Encode(&want))
+		assert.NoError(t, stored.Encode(&got))
+		decoded := New(50, WithStore(NewHeapStore(50)))
+		assert.NoError(t, decoded.Decode(bytes.NewReader(got.Bytes())))
+		assert.Equal(t, tk.Keys(), decoded.Keys())
+		assert.Empty(t, decoded.k.elts)
+		plain := &Stream{}
+		assert.NoError(t, plain.Decode(&got))
+		assert.Equal(t, tk.Keys(), plain.Keys())
+
+		assert.NoError(t, tk.Merge(plain))
+		assert.NoError(t, stored.Merge(decoded))
+		same()
+
+		src := New(50, opts...)
+		assert.NoError(t, src.Merge(stored))
+		assert.Equal(t, stored.Keys(), src.Keys())
+
+		assert.True(t, errors.Is(stored.WalkHeap(nil), ErrStore))
+
+		stored.Clear()
+		assert.Empty(t, stored.Keys())
+		assert.Zero(t, stored.store.Len())
+	}
+}
+
+func TestInsertChecked(t *testing.T) {
+	tk := New(2, WithSafeMode())
+	e, err := tk.InsertChecked("a", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, Element{Key: "a", Count: 2}, e)
+	_, err = tk.InsertChecked("b", 1)
+	assert.NoError(t, err)
+
+	// desync the index from the heap
+	tk.k.m["a"], tk.k.m["b"] = tk.k.m["b"], tk.k.m["a"]
+	_, err = tk.InsertChecked("a", 1)
+	assert.True(t, errors.Is(err, ErrInconsistent), "got %v", err)
+	_, err = tk.InsertChecked("c", 5)
+	assert.True(t, errors.Is(err, ErrInconsistent), "got %v", err)
+	tk.k.m["a"], tk.k.m["b"] = tk.k.m["b"], tk.k.m["a"]
+
+	// an index pointing past the heap
+	tk.k.m["b"] = 7
+	_, err = tk.InsertChecked("b", 1)
+	assert.True(t, errors.Is(err, ErrInconsistent), "got %v", err)
+
+	// without safe mode nothing is checked
+	tk = New(2)
+	tk.Insert("a", 1)
+	tk.k.m["a"] = 7
+	assert.Panics(t, func() { _, _ = tk.InsertChecked("a", 1) })
+}
+
+func TestKeysAndTotal(t *testing.T) {
+	tk := New(2)
+	tk.Insert("a", 3)
+	tk.Insert("b", 2)
+	tk.Insert("c", 1)
+	keys, total := tk.KeysAndTotal()
+	assert.Equal(t, tk.Keys(), keys)
+	assert.Equal(t, int64(6), total)
+
+	ls := NewLocked(10)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			ls.Insert(strconv.Itoa(i%5), 1)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		keys, total := ls.KeysAndTotal()
+		var sum int64
+		for _, e := range keys {
+			sum += int64(e.Count)
+		}
+		// every key is monitored, so the counts add up to the total
+		assert.Equal(t, total, sum)
+	}
+	wg.Wait()
+}
+
+func TestRankTransform(t *testing.T) {
+	log2 := func(c int) float64 { return math.Floor(math.Log2(float64(c))) }
+	fill := func(tk *Stream) *Stream {
+		tk.Insert("notable", 64)
+		tk.Insert("x", 50)
+		tk.Insert("frequent", 70) // evicts x, taking its count as error
+		return tk
+	}
+
+	// with linear ranks the lowest count is evicted
+	tk := fill(New(2, WithoutFilter()))
+	tk.Insert("new", 1)
+	assert.Equal(t, []Element{{Key: "frequent", Count: 120, Error: 50}, {Key: "new", Count: 65, Error: 64}}, tk.Keys())
+
+	// ranked by bucketed logarithm, 64 and 120 are in the same bucket, and
+	// the element with the larger error is evicted first
+	tk = fill(New(2, WithoutFilter(), WithRankTransform(log2)))
+	tk.Insert("new", 1)
+	assert.Equal(t, []Element{{Key: "new", Count: 121, Error: 120}, {Key: "notable", Count: 64}}, tk.Keys())
+	assert.NoError(t, tk.WalkHeap(nil))
+
+	// a strictly increasing transform changes nothing
+	tk = fill(New(2, WithoutFilter(), WithRankTransform(func(c int) float64 { return math.Log(float64(c)) })))
+	tk.Insert("new", 1)
+	assert.Equal(t, []Element{{Key: "frequent", Count: 120, Error: 50}, {Key: "new", Count: 65, Error: 64}}, tk.Keys())
+
+	// sorted by rank, storage need not be sorted by Count, which Keys still
+	// orders by, and the root need not have the minimum Count
+	tk = New(2, WithoutFilter(), WithSortedStorage(), WithRankTransform(log2))
+	tk.Insert("d", 33)
+	tk.Insert("x", 35)
+	tk.Insert("c", 25) // evicts d, taking its count as error
+	assert.Equal(t, "c", tk.k.elts[0].Key)
+	assert.Equal(t, []Element{{Key: "c", Count: 58, Error: 33}, {Key: "x", Count: 35}}, tk.Keys())
+	assert.Equal(t, 2*35, tk.InclusionThreshold())
+}
+
+func TestLockedResetN(t *testing.T) {
+	ls := NewLocked(10)
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					ls.Estimate("a")
+					ls.Insert("a", 1)
+				}
+			}
+		}()
+	}
+	for _, n := range []int{100, 5, 1000, 10} {
+		ls.ResetN(n)
+		ls.Insert("b", 1)
+	}
+	close(stop)
+	wg.Wait()
+	assert.Equal(t, 10, ls.Stats().N)
+}
+
+func TestKeysWithin(t *testing.T) {
+	tk := New(4)
+	tk.Insert("tenant1/a", 5)
+	tk.Insert("tenant1/b", 10)
+	tk.Insert("tenant2/a", 20)
+	tk.Insert("tenant1/c", 1)
+
+	// looked up
+	allowed := map[string]struct{}{"tenant1/a": {}, "tenant1/b": {}, "tenant1/d": {}}
+	assert.Equal(t, []Element{{Key: "tenant1/b", Count: 10}, {Key: "tenant1/a", Count: 5}}, tk.KeysWithin(allowed))
+
+	// scanned
+	for i := 0; i < 10; i++ {
+		allowed[strconv.Itoa(i)] = struct{}{}
+	}
+	assert.Equal(t, []Element{{Key: "tenant1/b", Count: 10}, {Key: "tenant1/a", Count: 5}}, tk.KeysWithin(allowed))
+
+	assert.Empty(t, tk.KeysWithin(nil))
+
+	tk = New(4, WithKeyNormalizer(strings.ToLower))
+	tk.Insert("A", 1)
+	assert.Equal(t, []Element{{Key: "a", Count: 1}}, tk.KeysWithin(map[string]struct{}{"A": {}, "a": {}}))
+}
+
+func TestResetReuse(t *testing.T) {
+	words := loadWords()[:5000]
+	tk := New(100, WithoutKeyCopy())
+	fresh := New(100, WithoutKeyCopy())
+	for _, w := range words {
+		tk.Insert(w, 1)
+	}
+	tk.ResetReuse()
+	for _, w := range words[:1000] {
+		tk.Insert(w, 1)
+		fresh.Insert(w, 1)
+	}
+	assert.Equal(t, fresh.Keys(), tk.Keys())
+	assert.Equal(t, fresh.Stats(), tk.Stats())
+
+	allocs := testing.AllocsPerRun(10, func() {
+		for _, w := range words[:1000] {
+			tk.Insert(w, 1)
+		}
+		tk.ResetReuse()
+	})
+	assert.Zero(t, allocs)
+}
+
+func BenchmarkResetReuse(b *testing.B) {
+	words := make([]string, 1000)
+	for i := range words {
+		words[i] = fmt.Sprintf("word-%d", i)
+	}
+
+	tk := New(100, WithoutKeyCopy())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, w := range words {
+			tk.Insert(w, 1)
+		}
+		tk.ResetReuse()
+	}
+}
+
+func TestAlphaHistogram(t *testing.T) {
+	tk := New(1)
+	assert.Nil(t, tk.AlphaHistogram(0))
+	assert.Equal(t, []int{6, 0, 0}, tk.AlphaHistogram(3))
+
+	for i, a := range []int{1, 2, 3, 4, 100} {
+		tk.alphas[i] = a
+	}
+	// 0 | 1 | 2-3 | 4-7 | 8+
+	assert.Equal(t, []int{1, 1, 2, 1, 1}, tk.AlphaHistogram(5))
+	assert.Equal(t, []int{1, 5}, tk.AlphaHistogram(2))
+
+	assert.Equal(t, []int{0, 0}, New(1, WithoutFilter()).AlphaHistogram(2))
+}
+
+func TestEncodeConfig(t *testing.T) {
+	tk := New(50,
+		WithAlphaRatio(3),
+		WithUint32Alphas(),
+		WithCardinality(),
+		WithHits(),
+		WithZeroCountQuery(),
+		WithKeysCache(),
+		WithMaxCount(1000),
+		WithRounding(RoundCeil),
+		WithMode(Signed),
+		WithEpochs(),
+		WithEvictionLog(5),
+		WithExactAbove(100, 2),
+		WithExpectedKeyLen(16),
+		WithWarmup(10),
+	)
+	tk.Insert("a", 500)
+
+	var buf bytes.Buffer
+	assert.NoError(t, tk.EncodeConfig(&buf))
+	decoded, err := DecodeConfig(&buf, WithKeyNormalizer(strings.ToLower))
+	assert.NoError(t, err)
+
+	assert.Equal(t, 50, decoded.N())
+	assert.Empty(t, decoded.Keys())
+	assert.Len(t, decoded.alphas32, 150)
+	assert.Nil(t, decoded.alphas)
+	assert.NotNil(t, decoded.hll)
+	assert.True(t, decoded.hits)
+	assert.True(t, decoded.query0)
+	assert.True(t, decoded.cacheKeys)
+	assert.Equal(t, 1000, decoded.maxCount)
+	assert.Equal(t, RoundCeil, decoded.rounding)
+	assert.Equal(t, Signed, decoded.mode)
+	assert.True(t, decoded.k.epochs)
+	assert.Len(t, decoded.evicted.buf, 5)
+	assert.Equal(t, 100, decoded.promoteAt)
+	assert.Equal(t, 2, decoded.maxPromoted)
+	assert.Equal(t, 16, decoded.keyLen)
+	assert.Equal(t, 10, decoded.warm.size)
+	assert.Equal(t, "a", decoded.Insert("A", 1).Key)
+
+	// data can be merged between streams sharing a configuration
+	assert.NoError(t, decoded.Merge(tk))
+
+	// the encoding is deterministic
+	var first, again bytes.Buffer
+	assert.NoError(t, tk.EncodeConfig(&first))
+	for i := 0; i < 10; i++ {
+		again.Reset()
+		assert.NoError(t, tk.EncodeConfig(&again))
+		assert.Equal(t, first.Bytes(), again.Bytes())
+	}
+
+	buf.Reset()
+	assert.NoError(t, New(10, WithoutFilter()).EncodeConfig(&buf))
+	config := buf.Bytes()
+	decoded, err = DecodeConfig(bytes.NewReader(config))
+	assert.NoError(t, err)
+	assert.True(t, decoded.nofilter)
+	assert.Zero(t, decoded.alphaLen())
+
+	_, err = DecodeConfig(bytes.NewReader(config[:len(config)-1]))
+	assert.True(t, errors.Is(err, ErrTruncated), "got %v", err)
+
+	// malformed configurations are rejected rather than allocated
+	malformed := func(fields map[string]interface{}) error {
+		buf.Reset()
+		w := msgp.NewWriter(&buf)
+		assert.NoError(t, w.WriteMapStrIntf(fields))
+		assert.NoError(t, w.Flush())
+		_, err := DecodeConfig(&buf)
+		return err
+	}
+	assert.ErrorIs(t, malformed(map[string]interface{}{"n": -1}), ErrInvalidN)
+	assert.ErrorIs(t, malformed(map[string]interface{}{"n": 1 << 62}), ErrInvalidN)
+	assert.ErrorIs(t, malformed(map[string]interface{}{"n": 1 << 20, "ratio": 1 << 20}), ErrInvalidN)
+	assert.ErrorIs(t, malformed(map[string]interface{}{"n": 10, "ratio": -1}), ErrInvalidN)
+	for _, name := range []string{"evictionlog", "arena", "warmup", "expectedkeylen", "maxcount", "mode", "rounding"} {
+		assert.ErrorIs(t, malformed(map[string]interface{}{"n": 10, name: -1}), ErrInconsistent, name)
+	}
+	assert.ErrorIs(t, malformed(map[string]interface{}{"n": 10, "mode": 7}), ErrInconsistent)
+	assert.ErrorIs(t, malformed(map[string]interface{}{"n": 10, "evictionlog": 1 << 62}), ErrInconsistent)
+}
+
+func TestCloneMergeKeepsKeysDistinct(t *testing.T) {
+	clone := func(s *Stream) *Stream {
+		var buf bytes.Buffer
+		assert.NoError(t, s.Encode(&buf))
+		c := New(s.n, WithSafeMode())
+		assert.NoError(t, c.Decode(&buf))
+		return c
+	}
+
+	r := rand.New(rand.NewSource(0))
+	zipf := rand.NewZipf(r, 1.2, 1, 1000)
+	tk := New(50, WithSafeMode(), WithExactAbove(200, 5))
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 1000; i++ {
+			tk.Insert(strconv.FormatUint(zipf.Uint64(), 10), 1)
+		}
+		c := clone(tk)
+		assert.NoError(t, c.Merge(tk))
+		assert.NoError(t, tk.Merge(c))
+		assert.NoError(t, tk.Merge(FromElements(50, c.Keys())))
+		assert.NoError(t, tk.checkIndex())
+		assert.NoError(t, c.checkIndex())
+	}
+
+	// a key monitored twice is detected before merging changes anything
+	other := clone(tk)
+	other.k.elts[1].Key = other.k.elts[0].Key
+	want := tk.Keys()
+	assert.True(t, errors.Is(tk.Merge(other), ErrInconsistent))
+	assert.Equal(t, want, tk.Keys())
+
+	c := clone(tk)
+	tk.k.elts[1].Key = tk.k.elts[0].Key
+	assert.True(t, errors.Is(tk.checkIndex(), ErrInconsistent))
+	keys := append([]Element(nil), tk.k.elts...)
+	promoted := len(tk.promoted)
+	assert.True(t, errors.Is(tk.Merge(c), ErrInconsistent))
+	assert.Equal(t, keys, tk.k.elts)
+	assert.Len(t, tk.promoted, promoted)
+}
+
+func TestTrack(t *testing.T) {
+	tk := New(2)
+	assert.True(t, tk.Track("important"))
+	assert.True(t, tk.Track("important"))
+	assert.Equal(t, []Element{{Key: "important"}}, tk.Keys())
+	assert.Equal(t, int64(0), tk.Stats().Total)
+
+	tk.Insert("a", 5)
+	assert.False(t, tk.Track("late"))
+	assert.Equal(t, Element{Key: "important", Count: 1}, tk.Insert("important", 1))
+
+	// tracked keys without inserts are evicted first
+	tk = New(2)
+	tk.Track("idle")
+	tk.Insert("a", 5)
+	tk.Insert("b", 1)
+	assert.Equal(t, []Element{{Key: "a", Count: 5}, {Key: "b", Count: 1}}, tk.Keys())
+}
+
+func TestRankedMap(t *testing.T) {
+	tk := New(3)
+	tk.Insert("b", 5)
+	tk.Insert("a", 5)
+	tk.Insert("c", 10)
+
+	assert.Equal(t, map[int]Element{
+		1: {Key: "c", Count: 10},
+		2: {Key: "a", Count: 5},
+	}, tk.RankedMap(2))
+	assert.Len(t, tk.RankedMap(10), 3)
+	assert.Equal(t, Element{Key: "b", Count: 5}, tk.RankedMap(10)[3])
+	assert.Empty(t, tk.RankedMap(0))
+	assert.Empty(t, tk.RankedMap(-1))
+}
+
+func TestExpectedKeyLen(t *testing.T) {
+	tk := New(100, WithExpectedKeyLen(16), WithKeyArena(64))
+	assert.Equal(t, 1600, tk.arena.size)
+	tk.Insert("0123456789abcdef", 1)
+	assert.Equal(t, 1600, cap(tk.arena.chunk))
+	tk.Clear()
+	assert.Equal(t, 1600, tk.arena.size)
+
+	assert.Equal(t, maxArenaChunk, New(1<<20, WithKeyArena(64), WithExpectedKeyLen(16)).arena.size)
+	assert.Nil(t, New(100, WithExpectedKeyLen(16)).arena)
+}
+
+func BenchmarkInsertFixedWidth(b *testing.B) {
+	const n = 10000
+	keys := make([]string, 1<<16)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%016x", i)
+	}
+
+	for _, hint := range []int{0, 16} {
+		b.Run(fmt.Sprintf("keylen=%d", hint), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				tk := New(n, WithKeyArena(256), WithExpectedKeyLen(hint))
+				for _, k := range keys[:n] {
+					tk.Insert(k, 1)
+				}
+			}
+		})
+	}
+}
+
+func TestKeysInto(t *testing.T) {
+	words := loadWords()[:20000]
+	tk := New(200)
+	for _, w := range words {
+		tk.Insert(w, 1)
+	}
+
+	dst := make([]Element, 10)
+	assert.Equal(t, 10, tk.KeysInto(dst))
+	assert.Equal(t, tk.Keys()[:10], dst)
+
+	// from the cache of Keys
+	assert.Equal(t, 10, tk.KeysInto(dst))
+	assert.Equal(t, tk.Keys()[:10], dst)
+
+	tk.Insert("new", 1)
+	allocs := testing.AllocsPerRun(10, func() { tk.KeysInto(dst) })
+	assert.Zero(t, allocs)
+
+	dst = make([]Element, 300)
+	dst[299] = Element{Key: "untouched"}
+	tk.Insert("newer", 1)
+	assert.Equal(t, 200, tk.KeysInto(dst))
+	assert.Equal(t, tk.Keys(), dst[:200])
+	assert.Equal(t, Element{Key: "untouched"}, dst[299])
+
+	assert.Zero(t, tk.KeysInto(nil))
+}
+
+func TestInsertAt(t *testing.T) {
+	tk := New(2, WithoutFilter())
+	assert.Equal(t, Element{Key: "a", Count: 1, FirstSeen: 100, LastSeen: 100}, tk.InsertAt("a", 1, 100))
+	assert.Equal(t, Element{Key: "a", Count: 3, FirstSeen: 100, LastSeen: 200}, tk.InsertAt("a", 2, 200))
+	tk.InsertAt("b", 5, 300)
+
+	var buf bytes.Buffer
+	assert.NoError(t, tk.Encode(&buf))
+	decoded := &Stream{}
+	assert.NoError(t, decoded.Decode(&buf))
+	assert.Equal(t, tk.Keys(), decoded.Keys())
+
+	// evicted and admitted again, a starts over
+	tk.InsertAt("c", 1, 400)
+	assert.Equal(t, Element{Key: "a", Count: 5, Error: 4, FirstSeen: 500, LastSeen: 500}, tk.InsertAt("a", 1, 500))
+
+	// merging keeps the earliest and latest times
+	other := New(2, WithoutFilter())
+	other.InsertAt("b", 1, 50)
+	other.InsertAt("b", 1, 900)
+	assert.NoError(t, tk.Merge(other))
+	b := tk.Estimate("b")
+	assert.Equal(t, int64(50), b.FirstSeen)
+	assert.Equal(t, int64(900), b.LastSeen)
+
+	// promoted elements keep their times through encoding
+	tk = New(2, WithExactAbove(10, 1))
+	tk.InsertAt("p", 20, 1)
+	tk.InsertAt("p", 1, 2)
+	buf.Reset()
+	assert.NoError(t, tk.Encode(&buf))
+	decoded = &Stream{}
+	assert.NoError(t, decoded.Decode(&buf))
+	assert.Equal(t, Element{Key: "p", Count: 21, FirstSeen: 1, LastSeen: 2}, decoded.Estimate("p"))
+
+	// an element promoted out of a store stays promoted
+	tk = New(5, WithStore(NewHeapStore(5)), WithExactAbove(10, 2))
+	tk.InsertAt("a", 5, 1)
+	assert.Equal(t, Element{Key: "a", Count: 25, FirstSeen: 1, LastSeen: 2}, tk.InsertAt("a", 20, 2))
+	assert.Len(t, tk.Keys(), 1)
+	assert.NoError(t, tk.Validate())
+}
+
+func TestValidate(t *testing.T) {
+	tk := New(100)
+	for _, w := range loadWords()[:5000] {
+		tk.Insert(w, 1)
+	}
+	assert.NoError(t, tk.Validate())
+	assert.NoError(t, New(0).Validate())
+	assert.NoError(t, (&Stream{}).Validate())
+
+	corrupt := func(f func(s *Stream)) error {
+		var buf bytes.Buffer
+		assert.NoError(t, tk.Encode(&buf))
+		s := &Stream{}
+		assert.NoError(t, s.Decode(&buf))
+		f(s)
+		return s.Validate()
+	}
+
+	err := corrupt(func(s *Stream) { s.k.elts[3].Error = s.k.elts[3].Count + 1 })
+	assert.True(t, errors.Is(err, ErrInconsistent), "got %v", err)
+	assert.Contains(t, err.Error(), "above its count")
+
+	err = corrupt(func(s *Stream) { s.k.elts[3].Error = -1 })
+	assert.Contains(t, err.Error(), "negative error")
+
+	err = corrupt(func(s *Stream) { s.k.elts[5].Count = 0; s.k.elts[5].Error = 0 })
+	assert.Contains(t, err.Error(), "orders before its parent")
+
+	err = corrupt(func(s *Stream) { s.alphas[7] = -3 })
+	assert.Contains(t, err.Error(), "negative filter count")
+
+	err = corrupt(func(s *Stream) { s.k.m[s.k.elts[0].Key] = 1 })
+	assert.True(t, errors.Is(err, ErrInconsistent), "got %v", err)
+
+	err = corrupt(func(s *Stream) { s.n = 10 })
+	assert.True(t, errors.Is(err, ErrInvalidN), "got %v", err)
+
+	// negative updates may take counts below their errors in signed mode
+	signed := New(2, WithMode(Signed), WithoutFilter())
+	signed.Insert("a", 1)
+	signed.Insert("b", 1)
+	signed.Insert("c", 2)
+	_, err = signed.Update("c", -2)
+	assert.NoError(t, err)
+	assert.NoError(t, signed.Validate())
+}
+
+func TestPrefixSummary(t *testing.T) {
+	tk := New(10)
+	tk.Insert("a/b/c", 3)
+	tk.Insert("a/b/d", 2)
+	tk.Insert("a/e", 4)
+	tk.Insert("f/a", 7)
+
+	keys, total := tk.PrefixSummary("a/b/")
+	assert.Equal(t, 2, keys)
+	assert.Equal(t, 5, total)
+
+	keys, total = tk.PrefixSummary("a/")
+	assert.Equal(t, 3, keys)
+	assert.Equal(t, 9, total)
+
+	keys, total = tk.PrefixSummary("")
+	assert.Equal(t, 4, keys)
+	assert.Equal(t, 16, total)
+
+	keys, total = tk.PrefixSummary("z/")
+	assert.Equal(t, 0, keys)
+	assert.Equal(t, 0, total)
+}
+
+func TestWarmup(t *testing.T) {
+	tk := New(2, WithWarmup(6))
+	for _, x := range []string{"a", "b", "c", "a", "c"} {
+		e := tk.Insert(x, 1)
+		assert.Equal(t, x, e.Key)
+	}
+	assert.Empty(t, tk.Keys())
+
+	// reads answer the buffered counts
+	assert.Equal(t, Element{Key: "a", Count: 2}, tk.Estimate("a"))
+	assert.Equal(t, Element{Key: "c", Count: 2}, tk.EstimateBytes([]byte("c")))
+	e, monitored, _ := tk.EstimateDebug("b")
+	assert.Equal(t, Element{Key: "b", Count: 1}, e)
+	assert.False(t, monitored)
+	assert.Equal(t, QueryResult{Key: "a", Count: 2, Lower: 2, Rank: -1}, tk.Query("a"))
+	assert.Equal(t, Element{Key: "z"}, tk.Estimate("z"))
+
+	// the last warm-up insert admits the most frequent keys
+	tk.Insert("c", 1)
+	assert.Equal(t, []Element{{Key: "c", Count: 3}, {Key: "a", Count: 2}}, tk.Keys())
+	assert.Equal(t, int64(6), tk.Stats().Total)
+
+	// afterwards inserts are counted as usual
+	tk.Insert("b", 1)
+	assert.Equal(t, Element{Key: "b", Count: 2, Error: 1}, tk.Estimate("b"))
+
+	// clearing restarts warm-up, which may end early
+	tk.Clear()
+	tk.Insert("d", 2)
+	assert.Empty(t, tk.Keys())
+	tk.EndWarmup()
+	assert.Equal(t, []Element{{Key: "d", Count: 2}}, tk.Keys())
+	tk.EndWarmup()
+	assert.Equal(t, []Element{{Key: "d", Count: 2}}, tk.Keys())
+
+	New(2).EndWarmup()
+
+	// Set replaces and Update decrements a buffered count
+	tk = New(2, WithWarmup(6), WithMode(Signed))
+	tk.Set("a", 10)
+	assert.Equal(t, Element{Key: "a", Count: 10}, tk.Set("a", 10))
+	assert.Equal(t, Element{Key: "a", Count: 10}, tk.Estimate("a"))
+	e, err := tk.Update("a", -5)
+	assert.NoError(t, err)
+	assert.Equal(t, Element{Key: "a", Count: 5}, e)
+	assert.Equal(t, int64(5), tk.Stats().Total)
+	tk.EndWarmup()
+	assert.Equal(t, []Element{{Key: "a", Count: 5}}, tk.Keys())
+
+	// Encode and Merge end warm-up rather than drop the buffered counts
+	tk = New(2, WithWarmup(6))
+	tk.Insert("a", 3)
+	var buf bytes.Buffer
+	assert.NoError(t, tk.Encode(&buf))
+	decoded := New(2)
+	assert.NoError(t, decoded.Decode(&buf))
+	assert.Equal(t, []Element{{Key: "a", Count: 3}}, decoded.Keys())
+
+	src := New(2, WithWarmup(6))
+	src.Insert("b", 2)
+	dst := New(2, WithWarmup(6))
+	dst.Insert("a", 1)
+	assert.NoError(t, dst.Merge(src))
+	assert.Equal(t, []Element{{Key: "b", Count: 2}, {Key: "a", Count: 1}}, dst.Keys())
+	assert.Equal(t, int64(3), dst.Stats().Total)
+
+	// starting warm-up over reuses the buffer
+	words := loadWords()[:1000]
+	tk = New(100, WithoutKeyCopy(), WithWarmup(500))
+	allocs := testing.AllocsPerRun(10, func() {
+		for _, w := range words[:400] {
+			tk.Insert(w, 1)
+		}
+		tk.ResetReuse()
+	})
+	assert.Zero(t, allocs)
+}
+
+func TestBatch(t *testing.T) {
+	fill := func() *Stream {
+		tk := New(100)
+		for _, w := range loadWords()[:5000] {
+			tk.Insert(w, 1)
+		}
+		return tk
+	}
+
+	want := fill()
+	want.Scale(0.5)
+	want.TrimToTop(50)
+	want.DecayElapsed(0.5, 2)
+
+	tk := fill()
+	tk.Batch(func(s *Stream) {
+		s.Scale(0.5)
+		s.Batch(func(s *Stream) {
+			s.TrimToTop(50)
+		})
+		assert.True(t, s.rebuild, "rebuild deferred to the outermost batch")
+		s.DecayElapsed(0.5, 2)
+	})
+	assert.False(t, tk.rebuild)
+	assert.NoError(t, tk.Validate())
+	assert.Equal(t, want.Keys(), tk.Keys())
+
+	// the heap is usable for inserts afterwards
+	tk.Insert("new", 1000)
+	assert.Equal(t, "new", tk.Keys()[0].Key)
+}
+
+func TestNewPercent(t *testing.T) {
+	for _, tt := range []struct {
+		distinct int
+		percent  float64
+		n        int
+	}{
+		{100000, 1, 1000},
+		{150, 1, 2},
+		{10, 0.01, 1},
+		{10, 100, 10},
+		{10, 0, 0},
+		{0, 50, 0},
+	} {
+		tk, err := NewPercent(tt.distinct, tt.percent, WithoutFilter())
+		assert.NoError(t, err)
+		assert.Equal(t, tt.n, tk.N(), "%d at %v%%", tt.distinct, tt.percent)
+	}
+
+	for _, p := range []float64{-1, 100.5, math.NaN(), math.Inf(1)} {
+		_, err := NewPercent(100, p)
+		assert.ErrorIs(t, err, ErrInvalidN, "percent %v", p)
+	}
+	_, err := NewPercent(-1, 1)
+	assert.ErrorIs(t, err, ErrInvalidN)
+}
+
+func TestStabilityReport(t *testing.T) {
+	tk := New(3)
+	tk.Insert("a", 10)
+	tk.Insert("b", 8)
+	tk.Insert("c", 2)
+	tk.Insert("d", 1)
+	tk.Insert("d", 1) // evicts c with an error of 1
+
+	assert.Equal(t, Stability{Guaranteed: 2, AtRisk: 0}, tk.StabilityReport(2))
+	assert.Equal(t, Stability{Guaranteed: 2, AtRisk: 1}, tk.StabilityReport(3))
+	assert.Equal(t, Stability{Guaranteed: 2, AtRisk: 1}, tk.StabilityReport(10))
+	assert.Equal(t, Stability{}, tk.StabilityReport(0))
+	assert.Equal(t, Stability{}, New(3).StabilityReport(3))
+
+	var guaranteed int
+	for _, e := range tk.KeysWithGuarantee(3) {
+		if e.Guaranteed {
+			guaranteed++
+		}
+	}
+	assert.Equal(t, guaranteed, tk.StabilityReport(3).Guaranteed)
+}
+
+func TestMergeIntoLarger(t *testing.T) {
+	words := loadWords()
+	want := make(map[string]int)
+	master := New(100000)
+	for shard := 0; shard < 20; shard++ {
+		// each shard sees fewer than n keys, so it never evicts
+		s := New(1000)
+		for _, w := range words[shard*500 : (shard+1)*500] {
+			s.Insert(w, 1)
+			want[w]++
+		}
+		assert.NoError(t, master.Merge(s))
+	}
+
+	keys := master.Keys()
+	assert.Len(t, keys, len(want))
+	for _, e := range keys {
+		assert.Equal(t, Element{Key: e.Key, Count: want[e.Key]}, e)
+	}
+
+	// a smaller destination cannot hold the source
+	assert.Error(t, New(10).Merge(master))
+}
+
+func TestZeroCountQuery(t *testing.T) {
+	var l recordingListener
+	tk := New(2, WithZeroCountQuery(), WithHits(), WithCardinality(), WithListener(&l))
+	tk.Insert("a", 3)
+	tk.Insert("b", 2)
+	tk.Insert("c", 1)
+
+	keys := tk.Keys()
+	alphas := append([]int(nil), tk.alphas...)
+	stats := tk.Stats()
+	calls := len(l.calls)
+
+	for _, x := range []string{"a", "c", "unseen"} {
+		e, a := tk.InsertClassified(x, 0)
+		assert.Equal(t, Queried, a)
+		assert.Equal(t, tk.Estimate(x), e)
+		tk.InsertAt(x, 0, 42)
+	}
+	assert.Equal(t, stats, tk.Stats())
+	assert.Len(t, l.calls, calls)
+
+	assert.Equal(t, keys, tk.Keys())
+	assert.Equal(t, alphas, tk.alphas)
+
+	// free space is not filled either
+	empty := New(2, WithZeroCountQuery())
+	empty.Insert("a", 0)
+	assert.Empty(t, empty.Keys())
+
+	// without the option an insert of 0 admits into free space
+	plain := New(2)
+	plain.Insert("a", 0)
+	assert.Equal(t, []Element{{Key: "a"}}, plain.Keys())
+}
+
+func TestSimilarity(t *testing.T) {
+	a, b := New(10), New(10)
+	for i, x := range []string{"a", "b", "c", "d"} {
+		a.Insert(x, 10-i)
+	}
+	for i, x := range []string{"b", "a", "e", "c"} {
+		b.Insert(x, 10-i)
+	}
+
+	assert.Equal(t, 1.0, Similarity(a, b, 2))
+	assert.Equal(t, 0.5, Similarity(a, b, 3))
+	assert.Equal(t, 3.0/5, Similarity(a, b, 4))
+	assert.Equal(t, 3.0/5, Similarity(a, b, 100))
+	assert.Equal(t, 1.0, Similarity(a, a, 4))
+	assert.Equal(t, 0.0, Similarity(a, New(10), 4))
+	assert.Equal(t, 1.0, Similarity(New(10), New(10), 4))
+	assert.Equal(t, 1.0, Similarity(a, b, 0))
+	assert.Equal(t, 1.0, Similarity(a, b, -1))
+
+	// counts are ignored
+	b.Insert("b", 1000)
+	assert.Equal(t, 1.0, Similarity(a, b, 2))
+}
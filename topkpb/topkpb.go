@@ -0,0 +1,151 @@
+// Package topkpb implements the protobuf messages described in topk.proto,
+// for exchanging top-k snapshots with services in other languages.
+//
+// The messages are encoded by hand in the protobuf wire format, so the topk
+// package can convert to and from them without depending on a protobuf
+// runtime.  Unknown fields are skipped when unmarshaling.
+package topkpb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// TopK is a snapshot of the monitored elements of a stream
+type TopK struct {
+	N        int64
+	Elements []Element
+}
+
+// Element is a monitored key with its estimated count
+type Element struct {
+	Key   string
+	Count int64
+	Error int64
+}
+
+// wire types
+const (
+	wireVarint = 0
+	wireI64    = 1
+	wireLen    = 2
+	wireI32    = 5
+)
+
+var errTruncated = errors.New("topkpb: truncated message")
+
+// Marshal returns the protobuf encoding of m
+func (m *TopK) Marshal() []byte {
+	var b []byte
+	if m.N != 0 {
+		b = appendVarintField(b, 1, uint64(m.N))
+	}
+	var elt []byte
+	for _, e := range m.Elements {
+		elt = e.appendTo(elt[:0])
+		b = binary.AppendUvarint(b, 2<<3|wireLen)
+		b = binary.AppendUvarint(b, uint64(len(elt)))
+		b = append(b, elt...)
+	}
+	return b
+}
+
+func (e *Element) appendTo(b []byte) []byte {
+	if e.Key != "" {
+		b = binary.AppendUvarint(b, 1<<3|wireLen)
+		b = binary.AppendUvarint(b, uint64(len(e.Key)))
+		b = append(b, e.Key...)
+	}
+	if e.Count != 0 {
+		b = appendVarintField(b, 2, uint64(e.Count))
+	}
+	if e.Error != 0 {
+		b = appendVarintField(b, 3, uint64(e.Error))
+	}
+	return b
+}
+
+func appendVarintField(b []byte, num int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(num)<<3|wireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+// Unmarshal decodes the protobuf encoding b into m, replacing its contents
+func (m *TopK) Unmarshal(b []byte) error {
+	*m = TopK{}
+	return eachField(b, func(num uint64, typ int, v uint64, data []byte) error {
+		switch {
+		case num == 1 && typ == wireVarint:
+			m.N = int64(v)
+		case num == 2 && typ == wireLen:
+			var e Element
+			if err := e.unmarshal(data); err != nil {
+				return err
+			}
+			m.Elements = append(m.Elements, e)
+		}
+		return nil
+	})
+}
+
+func (e *Element) unmarshal(b []byte) error {
+	return eachField(b, func(num uint64, typ int, v uint64, data []byte) error {
+		switch {
+		case num == 1 && typ == wireLen:
+			e.Key = string(data)
+		case num == 2 && typ == wireVarint:
+			e.Count = int64(v)
+		case num == 3 && typ == wireVarint:
+			e.Error = int64(v)
+		}
+		return nil
+	})
+}
+
+// eachField calls fn for each field of the message b, with the value of
+// varint fields in v and the payload of length-delimited fields in data
+func eachField(b []byte, fn func(num uint64, typ int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errTruncated
+		}
+		b = b[n:]
+
+		num, typ := tag>>3, int(tag&7)
+		var (
+			v    uint64
+			data []byte
+		)
+		switch typ {
+		case wireVarint:
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return errTruncated
+			}
+			b = b[n:]
+		case wireI64, wireI32:
+			sz := 8
+			if typ == wireI32 {
+				sz = 4
+			}
+			if len(b) < sz {
+				return errTruncated
+			}
+			b = b[sz:]
+		case wireLen:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errTruncated
+			}
+			data, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			return fmt.Errorf("topkpb: unsupported wire type %d", typ)
+		}
+
+		if err := fn(num, typ, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
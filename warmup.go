@@ -0,0 +1,101 @@
+package topk
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/dgryski/go-metro"
+)
+
+// WithWarmup buffers the first w inserts of the stream and then admits the
+// buffered keys from the most to the least frequent, instead of admitting
+// the first n distinct keys seen whatever their frequency.  This reduces the
+// error of short-lived streams, e.g. windows cleared with Clear or ResetN,
+// which start warm-up over.  After warm-up the stream behaves as usual.
+//
+// The buffer holds a count per distinct key, so it costs up to w keys and
+// their counts in memory, which is reused when warm-up starts over.  While
+// warming up, inserts are reported as Filtered, including to a Listener, and
+// buffered keys are not monitored: Keys and the other listings only see them
+// once warm-up ended, while Estimate, EstimateBytes, EstimateDebug and Query
+// answer their exact buffered counts.  Encode, its variants and Merge end
+// warm-up of the streams involved first, as EndWarmup does, so that no
+// buffered count is lost.  Admissions at the end of warm-up are not reported
+// to a Listener.  A w of 0 or less disables warm-up, which is the default.
+func WithWarmup(w int) Option {
+	return func(s *Stream) {
+		if w <= 0 {
+			s.warm = nil
+			return
+		}
+		s.warm = &warmup{size: w}
+		s.warm.restart()
+	}
+}
+
+// warmup buffers the counts of the first inserts
+type warmup struct {
+	size int
+	left int // inserts left to buffer, or 0 once warm-up ended
+	buf  map[string]Element
+}
+
+func (w *warmup) restart() {
+	w.left = w.size
+	if w.buf == nil {
+		w.buf = make(map[string]Element)
+	}
+	clear(w.buf)
+}
+
+// buffered returns the element buffered for x during warm-up, if any
+func (s *Stream) buffered(x string) (Element, bool) {
+	if s.warm == nil {
+		return Element{}, false
+	}
+	e, ok := s.warm.buf[x]
+	return e, ok
+}
+
+// buffer counts an insert of x during warm-up, ending it after the last one
+func (s *Stream) buffer(x string, count int, value, hit int64) (Element, Element, Admission) {
+	e, ok := s.warm.buf[x]
+	if !ok {
+		e.Key = x
+		if !s.nocopy {
+			e.Key = strings.Clone(x)
+		}
+	}
+	e.Count += count
+	e.Value += value
+	e.Hits += hit
+	s.warm.buf[e.Key] = e
+
+	if s.warm.left == 1 {
+		s.EndWarmup()
+	} else {
+		s.warm.left--
+	}
+	return Element{Key: x, Count: e.Count}, Element{}, Filtered
+}
+
+// EndWarmup ends warm-up early, admitting the buffered keys from the most to
+// the least frequent as if the last warm-up insert happened.  It is a no-op
+// if the stream was created without WithWarmup or already warmed up.
+func (s *Stream) EndWarmup() {
+	if s.warm == nil || s.warm.left == 0 {
+		return
+	}
+	s.warm.left = 0
+
+	elts := make([]Element, 0, len(s.warm.buf))
+	for _, e := range s.warm.buf {
+		elts = append(elts, e)
+	}
+	clear(s.warm.buf)
+	sort.Sort(elementsByCountDescending(elts))
+	for _, e := range elts {
+		s.count(e.Key, metro.Hash64Str(e.Key, 0), e.Count, e.Value, e.Hits)
+	}
+	s.invalidate()
+}